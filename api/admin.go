@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	ds "github.com/anyaddres/supermann/datastore"
+)
+
+// ErasureResponse reports what was removed for a right to erasure request.
+type ErasureResponse struct {
+	Subject         string `json:"subject"`
+	Logins          int64  `json:"logins"`
+	CachedLocations int    `json:"cachedLocations"`
+	AuditID         int64  `json:"auditId"`
+}
+
+// Erasure removes everything stored for a user.
+type Erasure interface {
+	EraseUser(ctx context.Context, username, actor string) (*ds.ErasureDAO, error)
+}
+
+func eraseUserData(ctx *SrvContext, w http.ResponseWriter, r *http.Request) (interface{}, *apiErr) {
+	username := strings.TrimPrefix(r.URL.Path, string(AdminUsers))
+	if username == "" || strings.Contains(username, "/") {
+		errs := url.Values{}
+		errs.Add("UserName", "Username is missing from the path")
+		return nil, newInvalidArgumentErr(errs)
+	}
+	tenant := tenantFrom(r)
+	resp, err := eraseUser(r.Context(), ctx.db.ForTenant(tenant), tenant, username, clientFrom(r).ID)
+	if err != nil {
+		return nil, newStageErr(r.Context(), stageDatastore, err)
+	}
+	return resp, nil
+}
+
+// EraseUser deletes every login and cached artefact of the tenant's user and records the erasure
+// in the audit log. The actor names who requested the erasure.
+func (s *Server) EraseUser(ctx context.Context, tenant, username, actor string) (*ErasureResponse, error) {
+	return eraseUser(ctx, s.srvContext.db.ForTenant(tenant), tenant, username, actor)
+}
+
+func eraseUser(ctx context.Context, db Erasure, tenant, username, actor string) (*ErasureResponse, error) {
+	erasure, err := db.EraseUser(ctx, username, actor)
+	if erasure == nil {
+		return nil, err
+	}
+	// The logins are gone even when the audit record could not be written, and so is what was
+	// derived from them.
+	cached := locationCache.remove(tenant, erasure.IpAddresses)
+	latestLogins.remove(tenant, username)
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "user erased", "subject", erasure.Subject, "tenant", tenant, "logins", erasure.Logins,
+		"audit_id", erasure.AuditID)
+	return &ErasureResponse{Subject: erasure.Subject, Logins: erasure.Logins,
+		CachedLocations: cached, AuditID: erasure.AuditID}, nil
+}
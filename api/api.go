@@ -1,14 +1,21 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/anyaddres/supermann/config"
 	ds "github.com/anyaddres/supermann/datastore"
 	"github.com/anyaddres/supermann/geoip"
+	"github.com/anyaddres/supermann/logging"
 	_ "github.com/mattn/go-sqlite3" // Registering the SQL Lite Driver
 )
 
@@ -18,8 +25,16 @@ type Route string
 const (
 	// IdentifyLogin ...
 	IdentifyLogin Route = "/api/identifylogins/"
+	// EventByUUID is the prefix for the single event routes, /api/events/{event_uuid}
+	EventByUUID Route = "/api/events/"
+	// AdminUsers is the prefix for the per user admin routes, /api/admin/users/{username}
+	AdminUsers Route = "/api/admin/users/"
+	// AdminLogLevel reads and changes the log level
+	AdminLogLevel Route = "/api/admin/loglevel"
+	// AdminGeoIP describes and reloads the GeoIP database
+	AdminGeoIP Route = "/api/admin/geoip"
 	// NumOfRoutes ...
-	NumOfRoutes = 1
+	NumOfRoutes = 5
 	// MaxOsThreads ...
 	MaxOsThreads = 100
 )
@@ -29,52 +44,130 @@ type (
 	SrvContext struct {
 		cfg *config.Config
 		db  *ds.DB
-		gip *geoip.GeoIP
+		// gip is loaded on first use by geoIP, gipMutex makes sure that happens once.
+		gip      atomic.Pointer[geoip.GeoIP]
+		gipMutex sync.Mutex
+		tenants  map[string]*Detection
 	}
 	// Server ...
 	Server struct {
 		srvContext *SrvContext
 		handle     map[Route]func(*SrvContext, http.ResponseWriter, *http.Request) (interface{}, *apiErr)
+		retention  *retentionJob
+		// clientLimiter, tenantLimiter and ipLimiter are nil unless rate limits are configured.
+		clientLimiter *rateLimiter
+		tenantLimiter *rateLimiter
+		ipLimiter     *rateLimiter
+		// shuttingDown is set once the server starts draining.
+		shuttingDown int32
 	}
 )
 
-var (
-	city struct {
-		Location struct {
-			AccuracyRadius uint16  `maxminddb:"accuracy_radius"`
-			Latitude       float64 `maxminddb:"latitude"`
-			Longitude      float64 `maxminddb:"longitude"`
-			MetroCode      uint    `maxminddb:"metro_code"`
-			TimeZone       string  `maxminddb:"time_zone"`
-		} `maxminddb:"location"`
-	}
-)
+// routeScopes lists the methods each route serves and the scope a client needs for them.
+var routeScopes = map[Route]map[string]Scope{
+	IdentifyLogin: {"POST": ScopeIngest},
+	EventByUUID:   {"GET": ScopeRead, "DELETE": ScopeAdmin},
+	AdminUsers:    {"DELETE": ScopeAdmin},
+	AdminLogLevel: {"GET": ScopeAdmin, "PUT": ScopeAdmin},
+	AdminGeoIP:    {"GET": ScopeAdmin, "POST": ScopeAdmin},
+}
 
 // ServeHTTP...
 func (s *Server) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
-	switch Route(req.RequestURI) {
-	case IdentifyLogin:
-		if req.Method != "POST" {
-			json.NewEncoder(writer).Encode(newNotImplemented(req.Method, req.RequestURI))
-			return
+	route := routeFor(req.URL.Path)
+	methods, ok := routeScopes[route]
+	if !ok {
+		return
+	}
+	scope, ok := methods[req.Method]
+	if !ok {
+		json.NewEncoder(writer).Encode(newNotImplemented(req.Method, req.RequestURI))
+		return
+	}
+	s.serve(route, scope, writer, req)
+}
+
+func (s *Server) serve(route Route, scope Scope, writer http.ResponseWriter, req *http.Request) {
+	writer.Header().Set("Content-type", "application/json")
+	start := time.Now()
+	// Requests are limited by ip address before their api key is looked up, so that a flood of
+	// invalid keys does not reach the datastore.
+	var client *Client
+	err := s.rateLimitIP(req)
+	if err == nil {
+		client, err = authenticate(s.srvContext, req)
+	}
+	if err == nil {
+		err = authorize(client, scope)
+	}
+	tenant := "-"
+	if err == nil {
+		tenant, err = tenantFor(client, req)
+	}
+	if err == nil {
+		err = s.rateLimit(client, tenant)
+	}
+	var apiResp interface{}
+	if err == nil {
+		ctx := withTenant(withClient(req.Context(), client), tenant)
+		if timeout := s.srvContext.cfg.RequestTimeout; timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		req = req.WithContext(ctx)
+		apiResp, err = s.handle[route](s.srvContext, writer, req)
+	}
+	logRequest(req, route, client, tenant, err, start)
+	if err != nil {
+		writeErr(writer, err)
+		return
+	}
+	json.NewEncoder(writer).Encode(apiResp)
+}
+
+// logRequest logs the outcome of a request, at error level for server errors. The usernames in
+// the paths of the admin user routes are logged as a user attribute so they can be redacted.
+func logRequest(req *http.Request, route Route, client *Client, tenant string, err *apiErr, start time.Time) {
+	clientID := "-"
+	if client != nil {
+		clientID = client.ID
+	}
+	path := req.URL.Path
+	attrs := []slog.Attr{slog.String("method", req.Method), slog.String("path", path), slog.String("client", clientID),
+		slog.String("tenant", tenant)}
+	if route == AdminUsers {
+		attrs[1] = slog.String("path", string(AdminUsers)+"{username}")
+		attrs = append(attrs, slog.String(logging.KeyUser, strings.TrimPrefix(path, string(AdminUsers))))
+	}
+	level, status := slog.LevelInfo, http.StatusOK
+	if err != nil {
+		status = err.Status
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+			attrs = append(attrs, slog.String(logging.KeyError, err.Desc))
 		}
-		writer.Header().Set("Content-type", "application/json")
-		// start := time.Now()
-		apiResp, err := s.handle[IdentifyLogin](s.srvContext, writer, req)
-		if err != nil {
-			json.NewEncoder(writer).Encode(err)
-			return
+	}
+	attrs = append(attrs, slog.Int("status", status), logging.Took(start))
+	slog.LogAttrs(req.Context(), level, "request", attrs...)
+}
+
+// routeFor maps a request path to its route. Routes ending in a path parameter are matched by
+// prefix, all the others have to match exactly.
+func routeFor(path string) Route {
+	for _, route := range []Route{EventByUUID, AdminUsers} {
+		if strings.HasPrefix(path, string(route)) {
+			return route
 		}
-		// log.Printf("***** identifySuspiciousLogins took %s\n", time.Since(start))
-		json.NewEncoder(writer).Encode(apiResp)
 	}
+	return Route(path)
 }
 
 func identifySuspiciousLogins(ctx *SrvContext, w http.ResponseWriter, r *http.Request) (interface{}, *apiErr) {
 	var loginEvent LoginRequest
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return nil, newInternalServerErr(err)
+		return nil, newBodyReadErr(err)
 	}
 	err = json.Unmarshal(data, &loginEvent)
 	if err != nil {
@@ -85,24 +178,64 @@ func identifySuspiciousLogins(ctx *SrvContext, w http.ResponseWriter, r *http.Re
 		return nil, newInvalidArgumentErr(validationErrs)
 	}
 
-	latLonForEntry, err := getLatLonForIP(ctx, &loginEvent)
-	if err != nil {
-		return nil, newInternalServerErr(err)
+	tenant := tenantFrom(r)
+	db := ctx.db.ForTenant(tenant)
+	var latLonForEntry *LoginInfo
+	stageErr := runStage(r.Context(), stageGeoIP, ctx.cfg.GeoIPTimeout, func(stageCtx context.Context) (err error) {
+		latLonForEntry, err = getLatLonForIP(stageCtx, ctx, tenant, &loginEvent)
+		return err
+	})
+	if stageErr != nil {
+		return nil, stageErr
+	}
 
+	// The login is scored, stored and cached before the next login of the user is scored.
+	unlock, err := loginLocks.lock(r.Context(), tenant, ctx.db.StoredUsers(loginEvent.UserName)...)
+	if err != nil {
+		return nil, newStageErr(r.Context(), stageNeighbours, err)
 	}
+	defer unlock()
 
-	prev, next, errs := closestNeighbouringLogins(ctx.db, &loginEvent, latLonForEntry)
-	if errs != nil {
-		serr := ""
-		for _, e := range errs {
-			serr += e.Error() + "\n"
-		}
-		return nil, newInternalServerErr(fmt.Errorf(serr))
+	var prev, next *Events
+	stageErr = runStage(r.Context(), stageNeighbours, ctx.cfg.NeighbourTimeout, func(stageCtx context.Context) error {
+		var errs []error
+		prev, next, errs = neighbouringLogins(stageCtx, tenant, db, &loginEvent, latLonForEntry, ctx.detection(tenant))
+		return errors.Join(errs...)
+	})
+	if stageErr != nil {
+		return nil, stageErr
 	}
+	recordVerdicts(r.Context(), &loginEvent, prev, next)
 
-	err = persistLoginInfo(ctx.db, &loginEvent, latLonForEntry)
-	if err != nil {
-		return nil, newInternalServerErr(err)
+	stageErr = storeLogin(r.Context(), ctx.cfg.PersistTimeout, tenant, db, &loginEvent, latLonForEntry, prev, next,
+		ctx.db.VisibleIP(loginEvent.IpAddress))
+	if stageErr != nil {
+		return nil, stageErr
 	}
 	return &Response{CurrentGeo: latLonForEntry, PrecedingIpAccess: prev, SubsequentIpAccess: next}, nil
 }
+
+// storeLogin persists the login and keeps the cached latest login of the user in step with the
+// datastore. A persist that failed or timed out may still commit, as the batched insert runs
+// detached from the request, so the cached latest login is dropped and the next login of the user
+// reads its preceding one from the datastore.
+func storeLogin(ctx context.Context, timeout time.Duration, tenant string, db LoginStore, entry *LoginRequest,
+	li *LoginInfo, prev, next *Events, visibleIP string) *apiErr {
+	stageErr := runStage(ctx, stagePersist, timeout, func(stageCtx context.Context) error {
+		return persistLoginInfo(stageCtx, db, entry, li, prev, next)
+	})
+	if stageErr != nil {
+		latestLogins.remove(tenant, entry.UserName)
+		return stageErr
+	}
+	if next == nil {
+		// The login is the user's latest, the next one finds it in the cache as stored.
+		stored := LoginInfo{Location: li.Location, Radius: li.Radius, Place: li.Place}
+		if prev != nil {
+			stored.Speed = prev.Speed
+		}
+		latestLogins.advance(tenant, entry.UserName, entry.EventUUID, Events{
+			Ip: visibleIP, TimeStamp: entry.UnixTimeStamp, LoginInfo: stored})
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/anyaddres/supermann/datastore"
+)
+
+// Scope is a set of operations an api key grants access to.
+type Scope string
+
+const (
+	// ScopeIngest allows posting login events.
+	ScopeIngest Scope = "ingest"
+	// ScopeRead allows reading stored login events.
+	ScopeRead Scope = "read"
+	// ScopeAdmin allows deleting events, erasing users and the other admin operations.
+	ScopeAdmin Scope = "admin"
+
+	// APIKeyPrefix starts every api key, which makes them easy to recognise in leaked text.
+	APIKeyPrefix = "sm_"
+	// AnonymousClient is the client every request is attributed to when authentication is disabled.
+	AnonymousClient = "anonymous"
+	// APIKeyCacheTTL is how long a verified api key is trusted before it is looked up again, and
+	// so how long a revoked key keeps working on other servers.
+	APIKeyCacheTTL = 30 * time.Second
+)
+
+// Scopes lists every known scope.
+var Scopes = []Scope{ScopeIngest, ScopeRead, ScopeAdmin}
+
+// Client is the authenticated caller of a request. A client bound to a tenant can only act for
+// that tenant, the others name the tenant in each request.
+type Client struct {
+	ID     string
+	Tenant string
+	Scopes []Scope
+}
+
+// NewAPIKey is returned once when a key is created. The key itself is not stored.
+type NewAPIKey struct {
+	ID       int64    `json:"id"`
+	ClientID string   `json:"clientId"`
+	Tenant   string   `json:"tenant,omitempty"`
+	Scopes   []string `json:"scopes"`
+	Key      string   `json:"key"`
+}
+
+type clientKey struct{}
+
+type cachedClient struct {
+	client  *Client
+	expires time.Time
+}
+
+// keyCache holds the clients of recently verified api keys by their hash, and those of client
+// certificates by their common name.
+var keyCache = struct {
+	sync.RWMutex
+	clients map[string]cachedClient
+}{clients: make(map[string]cachedClient)}
+
+func (c *Client) has(scope Scope) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func withClient(ctx context.Context, client *Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// clientFrom returns the client a request was authenticated as.
+func clientFrom(r *http.Request) *Client {
+	if client, ok := r.Context().Value(clientKey{}).(*Client); ok {
+		return client
+	}
+	return &Client{ID: AnonymousClient}
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate resolves the api key sent as a bearer token in the Authorization header, or else
+// the verified tls client certificate. A certificate authenticates the client whose id is its
+// common name and grants the scopes and tenant of that client's active api keys. When both are
+// sent they have to belong to the same client.
+func authenticate(ctx *SrvContext, r *http.Request) (*Client, *apiErr) {
+	if !ctx.cfg.AuthEnabled {
+		return &Client{ID: AnonymousClient, Scopes: Scopes}, nil
+	}
+	certID := certificateClient(r)
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		if certID != "" {
+			return certificateScopes(ctx, r, certID)
+		}
+		return nil, newUnauthorizedErr("Missing api key")
+	}
+	client, err := apiKeyClient(ctx, r, strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		return nil, err
+	}
+	if certID != "" && certID != client.ID {
+		return nil, newForbiddenErr("Api key of client %s used with the certificate of %s", client.ID, certID)
+	}
+	return client, nil
+}
+
+// certificateClient returns the common name of the verified client certificate of the request.
+func certificateClient(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+func certificateScopes(ctx *SrvContext, r *http.Request, clientID string) (*Client, *apiErr) {
+	if client := cachedClientFor("cert:" + clientID); client != nil {
+		return client, nil
+	}
+	keys, err := ctx.db.GetActiveAPIKeysForClient(r.Context(), clientID)
+	if err != nil {
+		return nil, newStageErr(r.Context(), stageDatastore, err)
+	}
+	client := &Client{ID: clientID}
+	seen := make(map[string]bool)
+	for i, key := range keys {
+		if i > 0 && boundTenant(key.Tenant) != client.Tenant {
+			return nil, newForbiddenErr("Api keys of client %s are bound to different tenants", clientID)
+		}
+		client.Tenant = boundTenant(key.Tenant)
+		for _, s := range key.Scopes {
+			if !seen[s] {
+				seen[s] = true
+				client.Scopes = append(client.Scopes, Scope(s))
+			}
+		}
+	}
+	cacheClient("cert:"+clientID, client)
+	return client, nil
+}
+
+// boundTenant returns the tenant the holder of a key of the given tenant is bound to, none for a key
+// of any tenant. A key stored without a tenant predates tenants and is bound to the default one.
+func boundTenant(keyTenant string) string {
+	switch keyTenant {
+	case ds.AnyTenant:
+		return ""
+	case "":
+		return ds.DefaultTenant
+	}
+	return keyTenant
+}
+
+func cachedClientFor(key string) *Client {
+	keyCache.RLock()
+	defer keyCache.RUnlock()
+	if cached, ok := keyCache.clients[key]; ok && time.Now().Before(cached.expires) {
+		return cached.client
+	}
+	return nil
+}
+
+func cacheClient(key string, client *Client) {
+	keyCache.Lock()
+	keyCache.clients[key] = cachedClient{client: client, expires: time.Now().Add(APIKeyCacheTTL)}
+	keyCache.Unlock()
+}
+
+func apiKeyClient(ctx *SrvContext, r *http.Request, apiKey string) (*Client, *apiErr) {
+	keyHash := hashAPIKey(apiKey)
+	if client := cachedClientFor(keyHash); client != nil {
+		return client, nil
+	}
+	key, err := ctx.db.GetAPIKeyByHash(r.Context(), keyHash)
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil, newUnauthorizedErr("Invalid api key")
+	}
+	if err != nil {
+		return nil, newStageErr(r.Context(), stageDatastore, err)
+	}
+	if key.RevokedUnix != 0 {
+		return nil, newUnauthorizedErr("Invalid api key")
+	}
+	client := &Client{ID: key.ClientID, Tenant: boundTenant(key.Tenant)}
+	for _, s := range key.Scopes {
+		client.Scopes = append(client.Scopes, Scope(s))
+	}
+	cacheClient(keyHash, client)
+	return client, nil
+}
+
+// authorize checks that the client of a request holds the scope the route requires.
+func authorize(client *Client, scope Scope) *apiErr {
+	if !client.has(scope) {
+		return newForbiddenErr("Client %s lacks the %s scope", client.ID, scope)
+	}
+	return nil
+}
+
+func parseScopes(scopes []string) ([]string, error) {
+	parsed := make([]string, 0, len(scopes))
+	for _, s := range scopes {
+		s = strings.TrimSpace(s)
+		known := false
+		for _, scope := range Scopes {
+			known = known || Scope(s) == scope
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown scope %q, expected one of %v", s, Scopes)
+		}
+		parsed = append(parsed, s)
+	}
+	if len(parsed) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return parsed, nil
+}
+
+// CreateAPIKey issues a new api key for the client, bound to the tenant unless it is empty. The
+// key is only returned here, the store keeps its hash. Key changes are audited under the default
+// tenant as keys are managed by the operator.
+func (s *Server) CreateAPIKey(ctx context.Context, clientID, tenant string, scopes []string, actor string) (*NewAPIKey, error) {
+	if clientID == "" {
+		return nil, errors.New("a client id is required")
+	}
+	if tenant == "" {
+		return nil, fmt.Errorf("a tenant is required, %s for a key of any tenant", ds.AnyTenant)
+	}
+	if tenant != ds.AnyTenant && !tenantPattern.MatchString(tenant) {
+		return nil, fmt.Errorf("invalid tenant %q", tenant)
+	}
+	scopes, err := parseScopes(scopes)
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return nil, err
+	}
+	key := APIKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	id, err := s.srvContext.db.InsertAPIKey(ctx, &ds.APIKeyDAO{ClientID: clientID, Tenant: tenant, KeyHash: hashAPIKey(key),
+		Scopes: scopes})
+	if err != nil {
+		return nil, err
+	}
+	audit := &ds.AuditDAO{Action: "create_api_key", Actor: actor, Subject: clientID,
+		Detail: fmt.Sprintf(`{"id":%d,"tenant":%q,"scopes":%q}`, id, tenant, strings.Join(scopes, ","))}
+	if _, err = s.srvContext.db.ForTenant(ds.DefaultTenant).InsertAudit(ctx, audit); err != nil {
+		return nil, err
+	}
+	return &NewAPIKey{ID: id, ClientID: clientID, Tenant: tenant, Scopes: scopes, Key: key}, nil
+}
+
+// ListAPIKeys returns every api key issued, without the keys themselves.
+func (s *Server) ListAPIKeys(ctx context.Context) ([]ds.APIKeyDAO, error) {
+	return s.srvContext.db.ListAPIKeys(ctx)
+}
+
+// RevokeAPIKey revokes the api key with the given id.
+func (s *Server) RevokeAPIKey(ctx context.Context, id int64, actor string) error {
+	revoked, err := s.srvContext.db.RevokeAPIKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return fmt.Errorf("no active api key with id %d", id)
+	}
+	audit := &ds.AuditDAO{Action: "revoke_api_key", Actor: actor, Subject: fmt.Sprint(id)}
+	_, err = s.srvContext.db.ForTenant(ds.DefaultTenant).InsertAudit(ctx, audit)
+	return err
+}
@@ -1,9 +1,18 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
+
+	ds "github.com/anyaddres/supermann/datastore"
+	"github.com/anyaddres/supermann/geoip"
 )
 
 type apiErr struct {
@@ -11,6 +20,8 @@ type apiErr struct {
 	Code             string     `json:"code,omitempty"`
 	Desc             string     `json:"desc,omitempty"`
 	ValidationErrors url.Values `json:"validation_errors,omitempty"`
+	// retryAfter is sent in the Retry-After header when set.
+	retryAfter time.Duration
 }
 
 // ErrUnsupportedMethod ...
@@ -21,6 +32,18 @@ func newNotFoundErr(format string, args ...interface{}) *apiErr {
 	return &apiErr{Status: http.StatusNotFound, Code: "not_found", Desc: fmt.Sprintf(format, args...)}
 }
 
+func newUnauthorizedErr(format string, args ...interface{}) *apiErr {
+	return &apiErr{Status: http.StatusUnauthorized, Code: "unauthorized", Desc: fmt.Sprintf(format, args...)}
+}
+
+func newInvalidSignatureErr(format string, args ...interface{}) *apiErr {
+	return &apiErr{Status: http.StatusUnauthorized, Code: "invalid_signature", Desc: fmt.Sprintf(format, args...)}
+}
+
+func newForbiddenErr(format string, args ...interface{}) *apiErr {
+	return &apiErr{Status: http.StatusForbidden, Code: "forbidden", Desc: fmt.Sprintf(format, args...)}
+}
+
 func newInvalidArgumentErr(errors url.Values) *apiErr {
 	return &apiErr{Status: http.StatusBadRequest, Code: "invalid_arguments", ValidationErrors: errors}
 }
@@ -29,7 +52,69 @@ func newInternalServerErr(err error) *apiErr {
 	return &apiErr{Status: http.StatusInternalServerError, Code: "internal_error", Desc: err.Error()}
 }
 
+// busyRetryAfter is how long clients are asked to wait before retrying a request that found the
+// datastore busy.
+const busyRetryAfter = time.Second
+
+// newStageErr reports the failure of a stage of serving a request. A stage stopped by its deadline
+// answers 504, one stopped because the client went away or finding the GeoIP databases unusable
+// 503, and any other failure answers as the kind of datastore failure it is, or 500.
+func newStageErr(ctx context.Context, stage string, err error) *apiErr {
+	// The driver may report an interrupted query rather than the context error, so the context is
+	// asked too.
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		stageTimeouts.With(stage).Inc()
+		return &apiErr{Status: http.StatusGatewayTimeout, Code: "timeout", Desc: fmt.Sprintf("The %s stage timed out", stage)}
+	case errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled):
+		return &apiErr{Status: http.StatusServiceUnavailable, Code: "canceled", Desc: fmt.Sprintf("The %s stage was canceled", stage)}
+	case errors.Is(err, ds.ErrNotFound):
+		return newNotFoundErr("The %s stage found nothing", stage)
+	case errors.Is(err, ds.ErrConflict):
+		return &apiErr{Status: http.StatusConflict, Code: "conflict", Desc: err.Error()}
+	case errors.Is(err, ds.ErrBusy):
+		return &apiErr{Status: http.StatusServiceUnavailable, Code: "busy", Desc: "The datastore is busy",
+			retryAfter: busyRetryAfter}
+	case errors.Is(err, ds.ErrCorrupt):
+		return &apiErr{Status: http.StatusInternalServerError, Code: "corrupt", Desc: "The datastore is corrupt"}
+	case errors.Is(err, geoip.ErrUnavailable):
+		return &apiErr{Status: http.StatusServiceUnavailable, Code: "geoip_unavailable",
+			Desc: "The GeoIP databases are not usable"}
+	}
+	return newInternalServerErr(err)
+}
+
+func newTooManyRequestsErr(retryAfter time.Duration, format string, args ...interface{}) *apiErr {
+	return &apiErr{Status: http.StatusTooManyRequests, Code: "too_many_requests", Desc: fmt.Sprintf(format, args...),
+		retryAfter: retryAfter}
+}
+
+func newRequestTooLargeErr(maxBytes int64) *apiErr {
+	return &apiErr{Status: http.StatusRequestEntityTooLarge, Code: "request_too_large",
+		Desc: fmt.Sprintf("Request body exceeds %d bytes", maxBytes)}
+}
+
+// newBodyReadErr reports a failure to read the request body, which is most likely the body
+// exceeding the size limit.
+func newBodyReadErr(err error) *apiErr {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return newRequestTooLargeErr(tooLarge.Limit)
+	}
+	return newInternalServerErr(err)
+}
+
 func newNotImplemented(method, uri string) *apiErr {
 	desc := fmt.Sprintf("%s Not Implemented on %s", method, uri)
 	return &apiErr{Status: http.StatusNotImplemented, Code: "not_implemented", Desc: desc}
 }
+
+// writeErr writes the error as the JSON response with its status.
+func writeErr(writer http.ResponseWriter, err *apiErr) {
+	writer.Header().Set("Content-type", "application/json")
+	if err.retryAfter > 0 {
+		writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(err.retryAfter.Seconds()))))
+	}
+	writer.WriteHeader(err.Status)
+	json.NewEncoder(writer).Encode(err)
+}
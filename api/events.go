@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	ds "github.com/anyaddres/supermann/datastore"
+)
+
+func eventByUUID(ctx *SrvContext, w http.ResponseWriter, r *http.Request) (interface{}, *apiErr) {
+	eventUUID := strings.TrimPrefix(r.URL.Path, string(EventByUUID))
+	if eventUUID == "" || strings.Contains(eventUUID, "/") {
+		errs := url.Values{}
+		errs.Add("EventUUID", "EventUUID is missing from the path")
+		return nil, newInvalidArgumentErr(errs)
+	}
+	tenant := tenantFrom(r)
+	db := ctx.db.ForTenant(tenant)
+	if r.Method == "DELETE" {
+		deleted, err := deleteEvent(r.Context(), tenant, db, eventUUID)
+		if err != nil {
+			return nil, err
+		}
+		audit := &ds.AuditDAO{Action: "delete_event", Actor: clientFrom(r).ID, Subject: eventUUID}
+		if _, auditErr := db.InsertAudit(r.Context(), audit); auditErr != nil {
+			return nil, newStageErr(r.Context(), stageDatastore, auditErr)
+		}
+		return deleted, nil
+	}
+	return getEvent(r.Context(), db, eventUUID)
+}
+
+func getEvent(ctx context.Context, db EventStore, eventUUID string) (*LoginEntry, *apiErr) {
+	lg, apiErr := findEvent(ctx, db, eventUUID)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	return toLoginEntry(lg), nil
+}
+
+func findEvent(ctx context.Context, db EventStore, eventUUID string) (*ds.LoginEntryDAO, *apiErr) {
+	lg, err := db.GetLoginByUUID(ctx, eventUUID)
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil, newNotFoundErr("Event %s not found", eventUUID)
+	}
+	if err != nil {
+		return nil, newStageErr(ctx, stageDatastore, err)
+	}
+	return lg, nil
+}
+
+// deleteEvent removes the event and recomputes the stored speed of the event that followed it, so
+// that it is relative to the event preceding the removed one. With no preceding event left the
+// stored speed is reset. The delete holds the lock of the user, so that no login of the user is
+// scored against the removed event or caches it meanwhile.
+func deleteEvent(ctx context.Context, tenant string, db EventStore, eventUUID string) (*LoginEntry, *apiErr) {
+	lg, apiErr := findEvent(ctx, db, eventUUID)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	unlock, err := loginLocks.lock(ctx, tenant, lg.UserName)
+	if err != nil {
+		return nil, newStageErr(ctx, stageDatastore, err)
+	}
+	defer unlock()
+	// The event is read again, as a login of the user may have moved it to the shard of the user
+	// before the lock was taken.
+	if lg, apiErr = findEvent(ctx, db, eventUUID); apiErr != nil {
+		return nil, apiErr
+	}
+	deleted := toLoginEntry(lg)
+	prev, next, errs := closestNeighbouringLogins(ctx, storedNeighbours{db, lg}, &deleted.LoginRequest, &deleted.LoginInfo, defaultDetection)
+	if errs != nil {
+		return nil, newStageErr(ctx, stageDatastore, errors.Join(errs...))
+	}
+	var nextID int64
+	var nextSpeed float64
+	if next != nil {
+		nextID = next.id
+		if prev != nil {
+			nextSpeed, _ = isTravelSuspicious(&LoginRequest{UnixTimeStamp: next.TimeStamp}, &next.LoginInfo, prev,
+				defaultDetection)
+		}
+	}
+	// A concurrent delete of the same event leaves nothing to delete.
+	err = db.DeleteLogin(ctx, lg.ID, nextID, nextSpeed)
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil, newNotFoundErr("Event %s not found", eventUUID)
+	}
+	if err != nil {
+		return nil, newStageErr(ctx, stageDatastore, err)
+	}
+	latestLogins.removeEvent(tenant, eventUUID)
+	return deleted, nil
+}
+
+// storedNeighbours searches the logins next to a login read back from the store, by the username and
+// in the shard it is stored under rather than by the username of a request.
+type storedNeighbours struct {
+	db EventStore
+	lg *ds.LoginEntryDAO
+}
+
+func (n storedNeighbours) GetLoginsForUserGreaterThanOrLessThan(ctx context.Context, _, operator string, ts int64) (*[]ds.LoginEntryDAO, error) {
+	return n.db.GetLoginsNextTo(ctx, n.lg, operator, ts)
+}
+
+func toLoginEntry(lg *ds.LoginEntryDAO) *LoginEntry {
+	loc := Location{Lat: lg.Lat, Lon: lg.Lon}
+	return &LoginEntry{
+		LoginRequest: LoginRequest(lg.LoginRequestDAO),
+		LoginInfo:    LoginInfo{Location: loc, Radius: lg.Radius, Speed: lg.Speed, Place: Place(lg.PlaceDAO)},
+	}
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/anyaddres/supermann/geoip"
+)
+
+// geoIP returns the GeoIP databases, opening them on first use. Concurrent first lookups wait for
+// the same load. A failed load is tried again by the next lookup.
+func (ctx *SrvContext) geoIP() (*geoip.GeoIP, error) {
+	if gip := ctx.gip.Load(); gip != nil {
+		return gip, nil
+	}
+	ctx.gipMutex.Lock()
+	defer ctx.gipMutex.Unlock()
+	if gip := ctx.gip.Load(); gip != nil {
+		return gip, nil
+	}
+	gip, err := geoip.NewGeoIP(ctx.cfg)
+	if err != nil {
+		return nil, err
+	}
+	ctx.gip.Store(gip)
+	return gip, nil
+}
+
+// geoIPDatabase describes the loaded GeoIP databases and reloads them on POST.
+func geoIPDatabase(ctx *SrvContext, w http.ResponseWriter, r *http.Request) (interface{}, *apiErr) {
+	if r.Method == "POST" {
+		info, err := reloadGeoIP(ctx)
+		if err != nil {
+			return nil, newInternalServerErr(err)
+		}
+		slog.InfoContext(r.Context(), "GeoIP database reload requested", "client", clientFrom(r).ID,
+			"generation", info.Generation)
+		return &info, nil
+	}
+	info := unloadedGeoIP(ctx)
+	if gip := ctx.gip.Load(); gip != nil {
+		info = gip.Info()
+	}
+	return &info, nil
+}
+
+// unloadedGeoIP describes the configured databases before they are loaded.
+func unloadedGeoIP(ctx *SrvContext) geoip.Info {
+	var info geoip.Info
+	specs, _ := geoip.Specs(ctx.cfg)
+	for _, spec := range specs {
+		info.Sources = append(info.Sources, geoip.Source{Kind: spec.Kind, Path: spec.Path})
+	}
+	return info
+}
+
+// ReloadGeoIP swaps in the GeoIP database files, the cached locations are dropped with the next
+// lookup. Nothing is done before the database is first used, it is opened fresh then.
+func (s *Server) ReloadGeoIP() (geoip.Info, error) {
+	return reloadGeoIP(s.srvContext)
+}
+
+func reloadGeoIP(ctx *SrvContext) (geoip.Info, error) {
+	gip := ctx.gip.Load()
+	if gip == nil {
+		return unloadedGeoIP(ctx), nil
+	}
+	return gip.Reload()
+}
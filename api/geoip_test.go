@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/anyaddres/supermann/config"
+	ds "github.com/anyaddres/supermann/datastore"
+	"github.com/anyaddres/supermann/geoip"
+	"github.com/stretchr/testify/assert"
+)
+
+// Run with -race, the lookups of many goroutines must neither mix up their locations nor race with
+// reloads of the database.
+func TestConcurrentLookups(t *testing.T) {
+	var ranges strings.Builder
+	for i := 1; i <= 64; i++ {
+		fmt.Fprintf(&ranges, "10.0.%d.0,10.0.%d.255,%d,%d,%d\n", i, i, i, -i, i)
+	}
+	path := filepath.Join(t.TempDir(), "ranges.csv")
+	if err := os.WriteFile(path, []byte(ranges.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv := &SrvContext{cfg: &config.Config{GeoIPProviders: "csv:" + path}}
+	gip, err := geoip.Open(srv.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gip.CloseGeoIPHandle()
+	srv.gip.Store(gip)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := gip.Reload(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	var lookups sync.WaitGroup
+	for g := 0; g < 32; g++ {
+		lookups.Add(1)
+		go func(g int) {
+			defer lookups.Done()
+			for n := 0; n < 200; n++ {
+				i := (g*200+n)%64 + 1
+				entry := &LoginRequest{IpAddress: fmt.Sprintf("10.0.%d.%d", i, n%256)}
+				rec, err := getLatLonForIP(context.Background(), srv, "race", entry)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if rec.Lat != float64(i) || rec.Lon != float64(-i) || rec.Radius != uint16(i) {
+					t.Errorf("%s located at %v,%v", entry.IpAddress, rec.Lat, rec.Lon)
+					return
+				}
+			}
+		}(g)
+	}
+	lookups.Wait()
+	close(stop)
+	wg.Wait()
+}
+
+func TestClosestNeighbouringLoginsCollectsErrors(t *testing.T) {
+	testObj := new(MockDB)
+	lr := &LoginRequest{UserName: "bob", UnixTimeStamp: 1483246800, IpAddress: "18.118.60.44"}
+	testObj.On("GetLoginsForUserGreaterThanOrLessThan", "bob", ">", int64(1483246800)).
+		Return((*[]ds.LoginEntryDAO)(nil), errors.New("database is locked"))
+	testObj.On("GetLoginsForUserGreaterThanOrLessThan", "bob", "<", int64(1483246800)).
+		Return((*[]ds.LoginEntryDAO)(nil), errors.New("disk I/O error"))
+	for n := 0; n < 50; n++ {
+		prev, next, errs := closestNeighbouringLogins(context.Background(), testObj, lr, &LoginInfo{}, defaultDetection)
+		assert.Nil(t, prev)
+		assert.Nil(t, next)
+		assert.Len(t, errs, 2, "Both failures should be reported")
+	}
+}
+
+func TestGeoIPUnavailable(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.csv")
+	srv := &SrvContext{cfg: &config.Config{GeoIPProviders: "csv:" + missing}}
+	for i := 0; i < 2; i++ {
+		_, err := getLatLonForIP(context.Background(), srv, ds.DefaultTenant, &LoginRequest{IpAddress: "10.0.0.1"})
+		assert.True(t, errors.Is(err, geoip.ErrUnavailable), "Missing databases should be unavailable, got %v", err)
+		assert.Nil(t, srv.gip.Load(), "A failed load should be tried again")
+		stageErr := newStageErr(context.Background(), stageGeoIP, err)
+		assert.Equal(t, 503, stageErr.Status, "Unusable databases should answer 503 rather than stop the server")
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ReadinessTimeout bounds the time taken by all the readiness checks together.
+	ReadinessTimeout = 2 * time.Second
+
+	statusOK   = "ok"
+	statusFail = "fail"
+)
+
+// Health is the response of the liveness and readiness endpoints.
+type Health struct {
+	Status string                  `json:"status"`
+	Checks map[string]*CheckResult `json:"checks,omitempty"`
+}
+
+// CheckResult is the outcome of checking one component.
+type CheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+	// Version and Pending are reported by the migrations check.
+	Version *int `json:"version,omitempty"`
+	Pending *int `json:"pending,omitempty"`
+}
+
+// Healthz reports that the process is up and serving requests. It checks no dependencies, so that
+// a failing database does not get the server restarted.
+func (s *Server) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, &Health{Status: statusOK})
+}
+
+// Readyz reports whether the server can serve requests, checking that it is not shutting down, a
+// datastore round trip, the GeoIP database and that the schema is fully migrated.
+func (s *Server) Readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ReadinessTimeout)
+	defer cancel()
+	health := &Health{Status: statusOK, Checks: map[string]*CheckResult{
+		"shutdown":   runCheck(s.checkShutdown),
+		"datastore":  runCheck(func() error { return s.srvContext.db.Ping(ctx) }),
+		"geoip":      runCheck(func() error { return s.checkGeoIP(ctx) }),
+		"migrations": s.checkMigrations(ctx),
+	}}
+	for _, check := range health.Checks {
+		if check.Status != statusOK {
+			health.Status = statusFail
+		}
+	}
+	writeHealth(w, health)
+}
+
+func writeHealth(w http.ResponseWriter, health *Health) {
+	w.Header().Set("Content-type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if health.Status != statusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
+func runCheck(check func() error) *CheckResult {
+	start := time.Now()
+	err := check()
+	result := &CheckResult{Status: statusOK, LatencyMs: float64(time.Since(start)) / float64(time.Millisecond)}
+	if err != nil {
+		result.Status, result.Error = statusFail, err.Error()
+	}
+	return result
+}
+
+func (s *Server) checkShutdown() error {
+	if atomic.LoadInt32(&s.shuttingDown) != 0 {
+		return errors.New("shutting down")
+	}
+	return nil
+}
+
+// checkGeoIP looks up an address in the GeoIP databases. A check before the first login loads the
+// databases the logins are looked up in, rather than opening them for each check.
+func (s *Server) checkGeoIP(ctx context.Context) error {
+	gip, err := s.srvContext.geoIP()
+	if err != nil {
+		return err
+	}
+	return gip.Check(ctx)
+}
+
+func (s *Server) checkMigrations(ctx context.Context) *CheckResult {
+	var version, latest int
+	result := runCheck(func() error {
+		var err error
+		if version, latest, err = s.srvContext.db.Migrations(ctx); err != nil {
+			return err
+		}
+		if version > latest {
+			return fmt.Errorf("schema version %d is newer than the %d migrations of this build", version, latest)
+		}
+		if version < latest {
+			return fmt.Errorf("%d migrations pending", latest-version)
+		}
+		return nil
+	})
+	pending := latest - version
+	result.Version, result.Pending = &version, &pending
+	return result
+}
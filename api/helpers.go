@@ -1,54 +1,72 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"log"
+	"log/slog"
 	"math"
 	"net"
 	"net/http"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"database/sql"
 	"github.com/anyaddres/supermann/config"
 	ds "github.com/anyaddres/supermann/datastore"
 	"github.com/anyaddres/supermann/geoip"
+	"github.com/anyaddres/supermann/logging"
+	"github.com/anyaddres/supermann/tracing"
 	"github.com/umahmood/haversine"
 )
 
-// LocationCache represents the Ip to Location Map for faster retrieval.
-type LocationCache struct {
-	ipAddressToLocation map[string]*LoginInfo
-	mutex               *sync.RWMutex
-}
-
-var locationCache = &LocationCache{ipAddressToLocation: make(map[string]*LoginInfo), mutex: &sync.RWMutex{}}
-
 const (
 	// SpeedThreshold ...
 	SpeedThreshold = 500
 )
 
-func getLatLonForIP(ctx *SrvContext, entry *LoginRequest) (*LoginInfo, error) {
-	locationCache.mutex.RLock()
-	if rec, ok := locationCache.ipAddressToLocation[entry.IpAddress]; ok {
-		locationCache.mutex.RUnlock()
+func getLatLonForIP(ctx context.Context, srv *SrvContext, tenant string, entry *LoginRequest) (*LoginInfo, error) {
+	ctx, span := tracing.Start(ctx, "geoip.lookup")
+	defer span.End()
+	gip, err := srv.geoIP()
+	if err != nil {
+		slog.ErrorContext(ctx, "GeoIP databases not loaded", logging.KeyError, err)
+		span.SetError(err)
+		return nil, err
+	}
+	locationCache.sync(gip.Generation())
+	if rec, ok := locationCache.get(tenant, entry.IpAddress); ok {
+		locationCacheLookups.With("hit").Inc()
+		span.SetAttribute("cache.hit", true)
+		slog.DebugContext(ctx, "location cached", logging.KeyIP, entry.IpAddress)
 		return rec, nil
 	}
-	locationCache.mutex.RUnlock()
+	locationCacheLookups.With("miss").Inc()
+	span.SetAttribute("cache.hit", false)
 	ip := net.ParseIP(entry.IpAddress)
-	if ctx.gip == nil {
-		ctx.gip = geoip.NewGeoIP(ctx.cfg)
+	start := time.Now()
+	found, generation, err := gip.Lookup(ctx, ip)
+	geoipDuration.With().Observe(time.Since(start).Seconds())
+	if errors.Is(err, geoip.ErrNotFound) {
+		// Addresses no database knows keep the zero location they always had.
+		found, err = &geoip.Location{}, nil
 	}
-	err := ctx.gip.GDB.Lookup(ip, &city)
 	if err != nil {
+		slog.ErrorContext(ctx, "geoip lookup failed", logging.KeyIP, entry.IpAddress, logging.KeyError, err)
+		span.SetError(err)
 		return nil, err
 	}
-	loc := Location{Lat: city.Location.Latitude, Lon: city.Location.Longitude}
-	rec := &LoginInfo{Location: loc, Radius: city.Location.AccuracyRadius}
-	locationCache.mutex.Lock()
-	locationCache.ipAddressToLocation[entry.IpAddress] = rec
-	locationCache.mutex.Unlock()
+	slog.DebugContext(ctx, "geoip lookup", logging.KeyIP, entry.IpAddress, "source", found.Source, logging.Took(start))
+	span.SetAttribute("geoip.source", found.Source)
+	loc := Location{Lat: found.Latitude, Lon: found.Longitude}
+	place := Place{Country: found.Country, CountryName: found.CountryName, Subdivision: found.Subdivision,
+		SubdivisionName: found.SubdivisionName, City: found.City, PostalCode: found.PostalCode, TimeZone: found.TimeZone}
+	rec := &LoginInfo{Location: loc, Radius: found.AccuracyRadius, Place: place}
+	if found.Source == geoip.KindOverride {
+		rec.Source, rec.Label = found.Source, found.Label
+	}
+	locationCache.store(tenant, entry.IpAddress, found.Network, rec, generation)
 	return rec, nil
 }
 
@@ -92,60 +110,70 @@ func findMax(eventsLessThan []Events) *Events {
 // will work for all ip addresses. It does not handle a case where in given an IP address
 // the geo db does not contain the lat and lon for that ip. In a real world scenario a
 // hacker could spoof the originating Ip addresses such that they dont map to a lat/lon.
-func isTravelSuspicious(entry *LoginRequest, latLonForReq *LoginInfo, prevsub *Events) (float64, bool) {
+func isTravelSuspicious(entry *LoginRequest, latLonForReq *LoginInfo, prevsub *Events, detection *Detection) (float64, bool) {
 	miles, _ := getDistanceBetweenLocations(latLonForReq.Location, prevsub.LoginInfo.Location)
 	ts1 := time.Unix(entry.UnixTimeStamp, 0)
 	ts2 := time.Unix(prevsub.TimeStamp, 0)
 	hours := math.Abs(ts1.Sub(ts2).Hours())
 	speed := miles / hours
-	if speed > SpeedThreshold {
+	if speed > detection.SpeedThreshold {
 		return speed, true
 	}
 	return speed, false
 }
 
-func subsequentEvent(db Searcher, entry *LoginRequest, latLonForReq *LoginInfo) (*Events, error) {
+func subsequentEvent(ctx context.Context, db Searcher, entry *LoginRequest, latLonForReq *LoginInfo, detection *Detection) (*Events, error) {
+	ctx, span := tracing.Start(ctx, "neighbour.subsequent")
+	defer span.End()
 	var subsequent *Events
-	largerSet, err := db.GetLoginsForUserGreaterThanOrLessThan(entry.UserName, ">", entry.UnixTimeStamp)
+	largerSet, err := db.GetLoginsForUserGreaterThanOrLessThan(ctx, entry.UserName, ">", entry.UnixTimeStamp)
 	// log.Printf("Got login entries having timestamp larger than current in %v", time.Since(start))
 	if err != nil {
+		span.SetError(err)
 		return nil, err
 	}
 	larger := make([]Events, 0)
 	for _, ele := range *largerSet {
 		loc := Location{Lat: ele.Lat, Lon: ele.Lon}
-		info := LoginInfo{Location: loc, Speed: ele.Speed, Radius: ele.Radius}
-		larger = append(larger, Events{Ip: ele.IpAddress, TimeStamp: ele.UnixTimeStamp, LoginInfo: info})
+		info := LoginInfo{Location: loc, Speed: ele.Speed, Radius: ele.Radius, Place: Place(ele.PlaceDAO)}
+		larger = append(larger, Events{id: ele.ID, Ip: ele.IpAddress, TimeStamp: ele.UnixTimeStamp, LoginInfo: info})
 	}
 	if len(*largerSet) > 0 {
 		// minStream := make(chan *Events, 1)
 		// t2 := time.Now()
 		subsequent = findMin(larger)
 		// subsequent = <-minStream
-		subsequent.Speed, subsequent.SuspiciousTravel = isTravelSuspicious(entry, latLonForReq, subsequent)
+		subsequent.Speed, subsequent.SuspiciousTravel = isTravelSuspicious(entry, latLonForReq, subsequent, detection)
+		span.SetAttribute("detection.speed", subsequent.Speed)
+		span.SetAttribute("detection.suspicious", subsequent.SuspiciousTravel)
 		return subsequent, nil
 	}
 	return nil, nil
 }
 
-func precedingEvent(db Searcher, entry *LoginRequest, latLonForReq *LoginInfo) (*Events, error) {
+func precedingEvent(ctx context.Context, db Searcher, entry *LoginRequest, latLonForReq *LoginInfo, detection *Detection) (*Events, error) {
+	ctx, span := tracing.Start(ctx, "neighbour.preceding")
+	defer span.End()
 	var preceding *Events
-	smallerSet, err := db.GetLoginsForUserGreaterThanOrLessThan(entry.UserName, "<", entry.UnixTimeStamp)
+	smallerSet, err := db.GetLoginsForUserGreaterThanOrLessThan(ctx, entry.UserName, "<", entry.UnixTimeStamp)
 	if err != nil {
+		span.SetError(err)
 		return nil, err
 	}
 	smaller := make([]Events, 0)
 	for _, ele := range *smallerSet {
 		loc := Location{Lat: ele.Lat, Lon: ele.Lon}
-		info := LoginInfo{Location: loc, Speed: ele.Speed, Radius: ele.Radius}
-		smaller = append(smaller, Events{Ip: ele.IpAddress, TimeStamp: ele.UnixTimeStamp, LoginInfo: info})
+		info := LoginInfo{Location: loc, Speed: ele.Speed, Radius: ele.Radius, Place: Place(ele.PlaceDAO)}
+		smaller = append(smaller, Events{id: ele.ID, Ip: ele.IpAddress, TimeStamp: ele.UnixTimeStamp, LoginInfo: info})
 	}
 	if len(*smallerSet) > 0 {
 		// maxStream := make(chan *Events, 1)
 		// t1 := time.Now()
 		preceding = findMax(smaller)
 		// preceding = <-maxStream
-		preceding.Speed, preceding.SuspiciousTravel = isTravelSuspicious(entry, latLonForReq, preceding)
+		preceding.Speed, preceding.SuspiciousTravel = isTravelSuspicious(entry, latLonForReq, preceding, detection)
+		span.SetAttribute("detection.speed", preceding.Speed)
+		span.SetAttribute("detection.suspicious", preceding.SuspiciousTravel)
 		return preceding, nil
 	}
 	return nil, nil
@@ -155,49 +183,73 @@ func precedingEvent(db Searcher, entry *LoginRequest, latLonForReq *LoginInfo) (
 // It divides the list of logins into 2 parts. Those having a timestamp greater than the current login
 // and those having a timestamp less than the current event. It then finds the max timestamp
 // among the less than events and min timestamp among the greater than events.
-func closestNeighbouringLogins(db Searcher, entry *LoginRequest, latLonForReq *LoginInfo) (*Events, *Events, []error) {
+func closestNeighbouringLogins(ctx context.Context, db Searcher, entry *LoginRequest, latLonForReq *LoginInfo, detection *Detection) (*Events, *Events, []error) {
+	ctx, span := tracing.Start(ctx, "detection.score")
+	defer span.End()
+	span.SetAttribute("detection.speed_threshold", detection.SpeedThreshold)
 	var wg sync.WaitGroup
-	var errs []error
 	var serr, perr error
 	var subsequent, preceding *Events
 	wg.Add(2)
 	go func() {
-		subsequent, serr = subsequentEvent(db, entry, latLonForReq)
+		subsequent, serr = subsequentEvent(ctx, db, entry, latLonForReq, detection)
 		if serr != nil {
-			log.Println(serr)
-			errs = append(errs, serr)
+			slog.ErrorContext(ctx, "finding the subsequent login failed", logging.KeyUser, entry.UserName,
+				logging.KeyError, serr)
 		}
 		wg.Done()
 	}()
 
 	go func() {
-		preceding, perr = precedingEvent(db, entry, latLonForReq)
+		preceding, perr = precedingEvent(ctx, db, entry, latLonForReq, detection)
 		if perr != nil {
-			log.Println(perr)
-			errs = append(errs, perr)
+			slog.ErrorContext(ctx, "finding the preceding login failed", logging.KeyUser, entry.UserName,
+				logging.KeyError, perr)
 		}
 		wg.Done()
 	}()
 	wg.Wait()
-	if serr != nil || perr != nil {
+	// Each goroutine only sets its own error, they are collected once both are done.
+	var errs []error
+	for _, err := range []error{serr, perr} {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if errs != nil {
+		span.SetError(errors.New("finding the neighbouring logins failed"))
 		return nil, nil, errs
 	}
 	return preceding, subsequent, nil
 }
 
-// This persists
-func persistLoginInfo(dao LoginStore, dp *LoginRequest, li *LoginInfo) error {
+// This persists the login along with the speed travelled since the preceding login. When the
+// login arrives out of order the subsequent login's stored speed is updated to be relative to it.
+func persistLoginInfo(ctx context.Context, dao LoginStore, dp *LoginRequest, li *LoginInfo, prev, next *Events) (err error) {
+	ctx, span := tracing.Start(ctx, "detection.persist")
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
 	start := time.Now()
-	loginInfo := ds.LoginInfoDAO{Lat: li.Lat, Lon: li.Lon, Radius: li.Radius, Speed: li.Speed}
+	loginInfo := ds.LoginInfoDAO{Lat: li.Lat, Lon: li.Lon, Radius: li.Radius, PlaceDAO: ds.PlaceDAO(li.Place)}
+	if prev != nil {
+		loginInfo.Speed = prev.Speed
+	}
 	loginDAO := &ds.LoginEntryDAO{
 		LoginRequestDAO: ds.LoginRequestDAO(*dp),
 		LoginInfoDAO:    loginInfo,
 	}
-	err := dao.InsertLogin(loginDAO)
+	err = dao.InsertLogin(ctx, loginDAO)
 	if err != nil {
 		return err
 	}
-	log.Printf("persistLoginInfo took %s", time.Since(start))
+	if next != nil {
+		if err = dao.UpdateLoginSpeed(ctx, next.id, next.Speed); err != nil {
+			return err
+		}
+	}
+	slog.DebugContext(ctx, "login persisted", "event_uuid", dp.EventUUID, logging.Took(start))
 	return nil
 }
 
@@ -205,24 +257,80 @@ func persistLoginInfo(dao LoginStore, dp *LoginRequest, li *LoginInfo) error {
 func NewServer() *Server {
 	cfg := config.GetConfig()
 	handlers := make(map[Route]func(*SrvContext, http.ResponseWriter, *http.Request) (interface{}, *apiErr), NumOfRoutes)
+	db := ds.NewDB(ds.ParseShards(cfg.DatabaseShards, cfg.DatabaseFile), ds.Options{ReadConns: cfg.DatabaseReadConns,
+		BatchWindow: cfg.DatabaseBatchWindow, BatchSize: cfg.DatabaseBatchSize, BusyRetries: cfg.DatabaseBusyRetries})
+	if len(cfg.PseudonymKeys) > 0 {
+		pseudo, err := ds.NewPseudonymizer(cfg.PseudonymKeys, cfg.PseudonymIPMode)
+		if err != nil {
+			log.Fatal(err)
+		}
+		db.UsePseudonymizer(pseudo)
+	}
+	tenants, err := loadTenantConfigs(cfg.TenantConfigFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	locationCache.configure(cfg.LocationCacheSize, cfg.LocationCacheTTL, cfg.LocationCacheByNetwork)
+	latestLogins.configure(cfg.LatestLoginCacheSize, cfg.LatestLoginCacheTTL)
 	srvContext := &SrvContext{
-		cfg: cfg,
-		db:  ds.NewDB(cfg.DatabaseFile),
+		cfg:     cfg,
+		db:      db,
+		tenants: tenants,
 	}
 	// add routes
 	handlers[IdentifyLogin] = identifySuspiciousLogins
+	handlers[EventByUUID] = eventByUUID
+	handlers[AdminUsers] = eraseUserData
+	handlers[AdminLogLevel] = logLevel
+	handlers[AdminGeoIP] = geoIPDatabase
 	server := &Server{
 		srvContext: srvContext,
 		handle:     handlers,
 	}
+	if cfg.RateLimitClient > 0 {
+		server.clientLimiter = newRateLimiter("client", cfg.RateLimitClient, cfg.RateLimitClientBurst)
+	}
+	if cfg.RateLimitTenant > 0 {
+		server.tenantLimiter = newRateLimiter("tenant", cfg.RateLimitTenant, cfg.RateLimitTenantBurst)
+	}
+	if cfg.RateLimitIP > 0 {
+		server.ipLimiter = newUnlistedRateLimiter("ip", cfg.RateLimitIP, cfg.RateLimitIPBurst)
+	}
 	runtime.GOMAXPROCS(MaxOsThreads)
 	return server
 }
 
-// ServerCleanup ...
+// Handler returns the server wrapped in the middleware the configuration asks for.
+func (s *Server) Handler() http.Handler {
+	var handler http.Handler = s
+	cfg := s.srvContext.cfg
+	if cfg.SigningSecret != "" {
+		handler = newSignatureVerifier(cfg.SigningSecret, cfg.SigningWindow, handler)
+	}
+	if cfg.MaxBodyBytes > 0 {
+		handler = &maxBodyHandler{maxBytes: cfg.MaxBodyBytes, next: handler}
+	}
+	return &requestIDHandler{next: &traceHandler{next: &metricsHandler{next: handler}}}
+}
+
+// StartShutdown makes the readiness check fail, so that no new requests are routed to the server
+// while it drains.
+func (s *Server) StartShutdown() {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+}
+
+// ServerCleanup stops the background jobs, then flushes and closes the datastore and closes the
+// GeoIP database. It is called once no more requests are served.
 func (s *Server) ServerCleanup() {
-	s.srvContext.db.CloseHandle()
-	s.srvContext.gip.CloseGeoIPHandle()
+	s.StopRetention()
+	if err := s.srvContext.db.CloseHandle(); err != nil {
+		slog.Error("closing the datastore failed", logging.KeyError, err)
+	}
+	if gip := s.srvContext.gip.Load(); gip != nil {
+		if err := gip.CloseGeoIPHandle(); err != nil {
+			slog.Error("closing the GeoIP database failed", logging.KeyError, err)
+		}
+	}
 }
 
 // DbPing Initial DB Ping Check on Server Startup
@@ -230,8 +338,7 @@ func (s *Server) DbPing() {
 	if s.srvContext.db == nil {
 		log.Fatal("DB Handle has not been initialized")
 	}
-	_, err := sql.Open("sqlite3", "./"+s.srvContext.db.GetDBName())
-	if err != nil {
-		panic(err)
+	if err := s.srvContext.db.Ping(context.Background()); err != nil {
+		log.Fatalf("DB %s is not usable: %v", s.srvContext.db.GetDBName(), err)
 	}
 }
@@ -1,6 +1,9 @@
 package api
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -43,7 +46,7 @@ func TestFindMax(t *testing.T) {
 func TestGetLatLonForIp(t *testing.T) {
 	ctx := &SrvContext{cfg: config.GetConfig()}
 	entry := &LoginRequest{IpAddress: "123.192.212.224"}
-	latLon, err := getLatLonForIP(ctx, entry)
+	latLon, err := getLatLonForIP(context.Background(), ctx, ds.DefaultTenant, entry)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -58,10 +61,42 @@ func TestIsTravelSuspiciousTrue(t *testing.T) {
 	loc2 := Location{Lat: 39.952583, Lon: -75.165222} // Philadelphia, PA
 	loginInfo := LoginInfo{Location: loc2}
 	event := &Events{LoginInfo: latLonReq, TimeStamp: time.Now().Add(-10 * time.Minute).Unix()}
-	_, isSuspiciousTravel := isTravelSuspicious(entry, &loginInfo, event)
+	_, isSuspiciousTravel := isTravelSuspicious(entry, &loginInfo, event, defaultDetection)
 	assert.True(t, isSuspiciousTravel, "Travel should be suspicious")
 }
 
+func TestIsTravelSuspiciousTenantThreshold(t *testing.T) {
+	entry := &LoginRequest{UnixTimeStamp: time.Now().Unix()}
+	loc1 := Location{Lat: 38.291962, Lon: -122.458000} // Sonoma,CA
+	loc2 := Location{Lat: 39.952583, Lon: -75.165222}  // Philadelphia, PA
+	event := &Events{LoginInfo: LoginInfo{Location: loc1}, TimeStamp: time.Now().Add(-5 * time.Hour).Unix()}
+	_, isSuspiciousTravel := isTravelSuspicious(entry, &LoginInfo{Location: loc2}, event, defaultDetection)
+	assert.True(t, isSuspiciousTravel, "Travel should be suspicious with the default threshold")
+	_, isSuspiciousTravel = isTravelSuspicious(entry, &LoginInfo{Location: loc2}, event, &Detection{SpeedThreshold: 600})
+	assert.False(t, isSuspiciousTravel, "Travel should not be suspicious with the tenant's higher threshold")
+}
+
+func TestTenantFor(t *testing.T) {
+	req := httptest.NewRequest("POST", "/api/identifylogins/", nil)
+	tenant, err := tenantFor(&Client{ID: "gateway"}, req)
+	assert.Nil(t, err)
+	assert.Equal(t, ds.DefaultTenant, tenant, "Requests naming no tenant should use the default tenant")
+
+	req.Header.Set(TenantHeader, "acme")
+	tenant, err = tenantFor(&Client{ID: "gateway"}, req)
+	assert.Nil(t, err)
+	assert.Equal(t, "acme", tenant, "Unbound clients should act for the tenant they name")
+
+	tenant, err = tenantFor(&Client{ID: "gateway", Tenant: "globex"}, req)
+	assert.NotNil(t, err, "Bound clients should not act for another tenant")
+}
+
+func TestBoundTenant(t *testing.T) {
+	assert.Equal(t, "acme", boundTenant("acme"))
+	assert.Equal(t, ds.DefaultTenant, boundTenant(""), "Keys from before tenants should be bound to the default tenant")
+	assert.Equal(t, "", boundTenant(ds.AnyTenant), "Keys of any tenant should be bound to none")
+}
+
 func TestIsTravelSuspiciousFalse(t *testing.T) {
 	entry := &LoginRequest{UnixTimeStamp: time.Now().Unix()}
 	loc1 := Location{Lat: 38.291962, Lon: -122.458000} // Sonoma,CA
@@ -69,7 +104,7 @@ func TestIsTravelSuspiciousFalse(t *testing.T) {
 	loc2 := Location{Lat: 39.952583, Lon: -75.165222} // Philadelphia, PA
 	loginInfo := LoginInfo{Location: loc2}
 	event := &Events{LoginInfo: latLonReq, TimeStamp: time.Now().Add(48 * time.Hour).Unix()}
-	_, isSuspiciousTravel := isTravelSuspicious(entry, &loginInfo, event)
+	_, isSuspiciousTravel := isTravelSuspicious(entry, &loginInfo, event, defaultDetection)
 	assert.False(t, isSuspiciousTravel, "Travel should not be suspicious")
 }
 
@@ -77,7 +112,7 @@ type MockDB struct {
 	mock.Mock
 }
 
-func (m *MockDB) GetLoginsForUserGreaterThanOrLessThan(username, operator string, ts int64) (*[]ds.LoginEntryDAO, error) {
+func (m *MockDB) GetLoginsForUserGreaterThanOrLessThan(ctx context.Context, username, operator string, ts int64) (*[]ds.LoginEntryDAO, error) {
 	args := m.Called(username, operator, ts)
 	return args.Get(0).(*[]ds.LoginEntryDAO), args.Error(1)
 }
@@ -113,7 +148,85 @@ func TestClosestNeighbouringLogins(t *testing.T) {
 	testObj.On("GetLoginsForUserGreaterThanOrLessThan", "bob", "<", int64(1483246800)).Return(&loginSmallerEntries, nil)
 
 	latLong := &LoginInfo{}
-	prev, next, _ := closestNeighbouringLogins(testObj, lr, latLong)
+	prev, next, _ := closestNeighbouringLogins(context.Background(), testObj, lr, latLong, defaultDetection)
 	assert.Equal(t, int64(1483160400), prev.TimeStamp, "Previous login entry should be equal to 1483160400")
 	assert.Equal(t, int64(1483333200), next.TimeStamp, "Next login entry should be equal to 1483333200")
 }
+
+func (m *MockDB) GetLoginByUUID(ctx context.Context, eventUUID string) (*ds.LoginEntryDAO, error) {
+	args := m.Called(eventUUID)
+	return args.Get(0).(*ds.LoginEntryDAO), args.Error(1)
+}
+
+func (m *MockDB) DeleteLogin(ctx context.Context, id, next int64, nextSpeed float64) error {
+	args := m.Called(id, next, nextSpeed)
+	return args.Error(0)
+}
+
+func (m *MockDB) GetLoginsNextTo(ctx context.Context, lg *ds.LoginEntryDAO, operator string, ts int64) (*[]ds.LoginEntryDAO, error) {
+	args := m.Called(lg.UserName, operator, ts)
+	return args.Get(0).(*[]ds.LoginEntryDAO), args.Error(1)
+}
+
+func TestDeleteEventUpdatesSubsequentSpeed(t *testing.T) {
+	sonoma := ds.LoginInfoDAO{Lat: 38.291962, Lon: -122.458000}
+	philadelphia := ds.LoginInfoDAO{Lat: 39.952583, Lon: -75.165222}
+	miles, _ := getDistanceBetweenLocations(Location{Lat: sonoma.Lat, Lon: sonoma.Lon},
+		Location{Lat: philadelphia.Lat, Lon: philadelphia.Lon})
+
+	// A pseudonymised store gives the logins back under the pseudonym they are stored under, which
+	// the neighbours are looked up by.
+	for _, stored := range []string{"bob", "u1:3f79bb7b435b05321651daefd374cdc681dc06faa65e374e38337b88ca046dea"} {
+		testObj := new(MockDB)
+		// The event being removed sits between a login in Sonoma and one in Philadelphia 10 hours later.
+		deleted := &ds.LoginEntryDAO{ID: 2, LoginRequestDAO: ds.LoginRequestDAO{UserName: stored,
+			UnixTimeStamp: 1483250400, EventUUID: "0b9a1bb2-8f7c-4a9b-b3a6-4ee2fd4b7f39"}, LoginInfoDAO: philadelphia}
+		testObj.On("GetLoginByUUID", deleted.EventUUID).Return(deleted, nil)
+		prev := ds.LoginEntryDAO{ID: 1, LoginRequestDAO: ds.LoginRequestDAO{UserName: stored,
+			UnixTimeStamp: 1483246800}, LoginInfoDAO: sonoma}
+		next := ds.LoginEntryDAO{ID: 3, LoginRequestDAO: ds.LoginRequestDAO{UserName: stored,
+			UnixTimeStamp: 1483282800}, LoginInfoDAO: philadelphia}
+		testObj.On("GetLoginsNextTo", stored, "<", int64(1483250400)).Return(&[]ds.LoginEntryDAO{prev}, nil)
+		testObj.On("GetLoginsNextTo", stored, ">", int64(1483250400)).Return(&[]ds.LoginEntryDAO{next}, nil)
+		testObj.On("DeleteLogin", int64(2), int64(3), miles/10).Return(nil)
+
+		entry, err := deleteEvent(context.Background(), "t", testObj, deleted.EventUUID)
+		assert.Nil(t, err, "Deleting an existing event of %s should not fail", stored)
+		assert.Equal(t, deleted.EventUUID, entry.EventUUID, "The deleted event should be returned")
+		testObj.AssertExpectations(t)
+	}
+}
+
+func TestDeleteEventWaitsForLoginsOfTheUser(t *testing.T) {
+	testObj := new(MockDB)
+	deleted := &ds.LoginEntryDAO{ID: 2, LoginRequestDAO: ds.LoginRequestDAO{UserName: "bob",
+		UnixTimeStamp: 1483250400, EventUUID: "0b9a1bb2-8f7c-4a9b-b3a6-4ee2fd4b7f39"}}
+	testObj.On("GetLoginByUUID", deleted.EventUUID).Return(deleted, nil)
+	unlock, err := loginLocks.lock(context.Background(), "t", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	timeout, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, apiErr := deleteEvent(timeout, "t", testObj, deleted.EventUUID)
+	assert.NotNil(t, apiErr, "The delete should wait for the login of the user being scored")
+	testObj.AssertNotCalled(t, "GetLoginsNextTo", "bob", "<", int64(1483250400))
+	testObj.AssertNotCalled(t, "DeleteLogin", int64(2), int64(0), float64(0))
+}
+
+func TestGetMissingEvent(t *testing.T) {
+	testObj := new(MockDB)
+	eventUUID := "85ad929a-db03-4bf4-9541-8f728fa12e41"
+	testObj.On("GetLoginByUUID", eventUUID).Return((*ds.LoginEntryDAO)(nil), ds.ErrNotFound)
+
+	_, err := getEvent(context.Background(), testObj, eventUUID)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusNotFound, err.Status, "A missing event should answer 404")
+	}
+	_, err = deleteEvent(context.Background(), "t", testObj, eventUUID)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusNotFound, err.Status, "Deleting a missing event should answer 404")
+	}
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/anyaddres/supermann/tracing"
+)
+
+// LatestLoginCache holds the most recent login of each active user, as stored, so that the
+// preceding login of a newer one needs no datastore read. It holds at most size users, dropping
+// the least recently active first. A user is only cached while the cached login is known to be
+// their latest. An entry is dropped ttl after it was cached, which bounds how long the cache keeps a
+// login that another process, such as the erase command, removed from the datastore.
+type LatestLoginCache struct {
+	mutex   sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[latestKey]*list.Element
+	// recent holds the entries, the most recently used first.
+	recent *list.List
+}
+
+type latestKey struct {
+	tenant   string
+	username string
+}
+
+type latestEntry struct {
+	key       latestKey
+	eventUUID string
+	event     Events
+	// expires is when the entry is dropped, never when zero.
+	expires time.Time
+}
+
+// latestLogins is configured by NewServer.
+var latestLogins = newLatestLoginCache(100000)
+
+func newLatestLoginCache(size int) *LatestLoginCache {
+	return &LatestLoginCache{size: size, entries: make(map[latestKey]*list.Element), recent: list.New()}
+}
+
+// configure changes the size of the cache, dropping the users past it, and the time the logins are
+// cached for, zero caching them until they are replaced.
+func (c *LatestLoginCache) configure(size int, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.size = size
+	c.ttl = ttl
+	for c.recent.Len() > max(size, 0) {
+		c.delete(c.recent.Back())
+	}
+}
+
+// get returns a copy of the latest login of the user.
+func (c *LatestLoginCache) get(tenant, username string) (Events, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[latestKey{tenant, username}]
+	if !ok {
+		return Events{}, false
+	}
+	if expires := element.Value.(*latestEntry).expires; !expires.IsZero() && time.Now().After(expires) {
+		c.delete(element)
+		return Events{}, false
+	}
+	c.recent.MoveToFront(element)
+	return element.Value.(*latestEntry).event, true
+}
+
+// advance caches the event as the latest login of the user, unless a later one is cached. The
+// caller must know the event to be the user's latest login when none is cached.
+func (c *LatestLoginCache) advance(tenant, username, eventUUID string, event Events) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.size <= 0 {
+		return
+	}
+	key := latestKey{tenant, username}
+	entry := &latestEntry{key: key, eventUUID: eventUUID, event: event}
+	if c.ttl > 0 {
+		entry.expires = time.Now().Add(c.ttl)
+	}
+	if element, ok := c.entries[key]; ok {
+		if element.Value.(*latestEntry).event.TimeStamp < event.TimeStamp {
+			element.Value = entry
+		}
+		c.recent.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.recent.PushFront(entry)
+	for c.recent.Len() > c.size {
+		c.delete(c.recent.Back())
+	}
+}
+
+func (c *LatestLoginCache) delete(element *list.Element) {
+	entry := c.recent.Remove(element).(*latestEntry)
+	delete(c.entries, entry.key)
+}
+
+// remove drops the user, whose logins were erased.
+func (c *LatestLoginCache) remove(tenant, username string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[latestKey{tenant, username}]; ok {
+		c.delete(element)
+	}
+}
+
+// removeEvent drops the user whose cached latest login is the deleted event. The login before it
+// is read from the datastore again.
+func (c *LatestLoginCache) removeEvent(tenant, eventUUID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, element := range c.entries {
+		if key.tenant == tenant && element.Value.(*latestEntry).eventUUID == eventUUID {
+			c.delete(element)
+		}
+	}
+}
+
+// expire drops the users whose latest login is older than cutoff, which the retention purge may
+// have deleted.
+func (c *LatestLoginCache) expire(cutoff int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, element := range c.entries {
+		if element.Value.(*latestEntry).event.TimeStamp < cutoff {
+			c.delete(element)
+		}
+	}
+}
+
+// userLocks serialises the logins of each user from reading their neighbours to caching the stored
+// login. Concurrent logins of a user would otherwise both be scored against the same cached latest
+// login, the later one missing the earlier. The deletes of events take the lock of the user too.
+// Users are locked by the usernames their logins are stored under, which is all a deleted event
+// tells when usernames are pseudonymised.
+type userLocks struct {
+	mutex sync.Mutex
+	locks map[latestKey]*userLock
+}
+
+type userLock struct {
+	held chan struct{}
+	// waiters counts the requests holding or waiting for the lock, which is dropped with the last.
+	waiters int
+}
+
+var loginLocks = &userLocks{locks: make(map[latestKey]*userLock)}
+
+// lock waits for the locks of the usernames, in order, until ctx is done, and returns the function
+// releasing them.
+func (l *userLocks) lock(ctx context.Context, tenant string, usernames ...string) (func(), error) {
+	unlocks := make([]func(), 0, len(usernames))
+	unlockAll := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for _, username := range usernames {
+		unlock, err := l.lockOne(ctx, latestKey{tenant, username})
+		if err != nil {
+			unlockAll()
+			return nil, err
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	return unlockAll, nil
+}
+
+func (l *userLocks) lockOne(ctx context.Context, key latestKey) (func(), error) {
+	l.mutex.Lock()
+	ul, ok := l.locks[key]
+	if !ok {
+		ul = &userLock{held: make(chan struct{}, 1)}
+		l.locks[key] = ul
+	}
+	ul.waiters++
+	l.mutex.Unlock()
+	select {
+	case ul.held <- struct{}{}:
+		return func() {
+			<-ul.held
+			l.release(key, ul)
+		}, nil
+	case <-ctx.Done():
+		l.release(key, ul)
+		return nil, ctx.Err()
+	}
+}
+
+func (l *userLocks) release(key latestKey, ul *userLock) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if ul.waiters--; ul.waiters == 0 {
+		delete(l.locks, key)
+	}
+}
+
+// neighbouringLogins finds the closest logins around the entry like closestNeighbouringLogins.
+// When the entry is later than the user's cached latest login, that login precedes it and none
+// follows, and the datastore is not read.
+func neighbouringLogins(ctx context.Context, tenant string, db Searcher, entry *LoginRequest, latLonForReq *LoginInfo, detection *Detection) (*Events, *Events, []error) {
+	latest, ok := latestLogins.get(tenant, entry.UserName)
+	switch {
+	case !ok:
+		latestLoginLookups.With("miss").Inc()
+	case entry.UnixTimeStamp <= latest.TimeStamp:
+		latestLoginLookups.With("out_of_order").Inc()
+	default:
+		latestLoginLookups.With("hit").Inc()
+		_, span := tracing.Start(ctx, "detection.score")
+		defer span.End()
+		span.SetAttribute("detection.speed_threshold", detection.SpeedThreshold)
+		span.SetAttribute("cache.hit", true)
+		preceding := &latest
+		preceding.Speed, preceding.SuspiciousTravel = isTravelSuspicious(entry, latLonForReq, preceding, detection)
+		span.SetAttribute("detection.speed", preceding.Speed)
+		span.SetAttribute("detection.suspicious", preceding.SuspiciousTravel)
+		return preceding, nil, nil
+	}
+	return closestNeighbouringLogins(ctx, db, entry, latLonForReq, detection)
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ds "github.com/anyaddres/supermann/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNeighbouringLoginsFromCache(t *testing.T) {
+	defer latestLogins.remove("cached", "bob")
+	latestLogins.advance("cached", "bob", "85ad929a-db03-4bf4-9541-8f728fa12e42", Events{Ip: "18.118.60.44",
+		TimeStamp: 1483246800, LoginInfo: LoginInfo{Location: Location{Lat: 38.291962, Lon: -122.458}}})
+	// The mock fails the test on any datastore read.
+	testObj := new(MockDB)
+	lr := &LoginRequest{UserName: "bob", UnixTimeStamp: 1483250400, IpAddress: "82.233.123.117"}
+	prev, next, errs := neighbouringLogins(context.Background(), "cached", testObj, lr,
+		&LoginInfo{Location: Location{Lat: 39.952583, Lon: -75.165222}}, defaultDetection)
+	assert.Nil(t, errs)
+	assert.Nil(t, next, "No login should follow the latest one")
+	assert.Equal(t, "18.118.60.44", prev.Ip)
+	assert.True(t, prev.SuspiciousTravel, "The preceding login should be scored")
+	testObj.AssertExpectations(t)
+
+	cached, _ := latestLogins.get("cached", "bob")
+	assert.False(t, cached.SuspiciousTravel, "Scoring should not change the cached login")
+}
+
+func TestNeighbouringLoginsOutOfOrder(t *testing.T) {
+	defer latestLogins.remove("cached", "alice")
+	latestLogins.advance("cached", "alice", "85ad929a-db03-4bf4-9541-8f728fa12e42",
+		Events{Ip: "18.118.60.44", TimeStamp: 1483246800})
+	testObj := new(MockDB)
+	later := []ds.LoginEntryDAO{{LoginRequestDAO: ds.LoginRequestDAO{UserName: "alice", UnixTimeStamp: 1483246800}}}
+	testObj.On("GetLoginsForUserGreaterThanOrLessThan", "alice", ">", int64(1483243200)).Return(&later, nil)
+	testObj.On("GetLoginsForUserGreaterThanOrLessThan", "alice", "<", int64(1483243200)).
+		Return(&[]ds.LoginEntryDAO{}, nil)
+	lr := &LoginRequest{UserName: "alice", UnixTimeStamp: 1483243200, IpAddress: "82.233.123.117"}
+	prev, next, errs := neighbouringLogins(context.Background(), "cached", testObj, lr, &LoginInfo{}, defaultDetection)
+	assert.Nil(t, errs)
+	assert.Nil(t, prev)
+	assert.Equal(t, int64(1483246800), next.TimeStamp, "A login older than the cached one should read the datastore")
+	testObj.AssertExpectations(t)
+}
+
+func (m *MockDB) InsertLogin(ctx context.Context, lg *ds.LoginEntryDAO) error {
+	return m.Called(lg.EventUUID).Error(0)
+}
+
+func (m *MockDB) UpdateLoginSpeed(ctx context.Context, id int64, speed float64) error {
+	return m.Called(id, speed).Error(0)
+}
+
+func TestStoreLoginKeepsLatestLoginInStep(t *testing.T) {
+	defer latestLogins.remove("cached", "carol")
+	latestLogins.advance("cached", "carol", "85ad929a-db03-4bf4-9541-8f728fa12e42",
+		Events{Ip: "18.118.60.44", TimeStamp: 1483246800})
+	testObj := new(MockDB)
+	testObj.On("InsertLogin", "85ad929a-db03-4bf4-9541-8f728fa12e43").Return(nil)
+	testObj.On("InsertLogin", "85ad929a-db03-4bf4-9541-8f728fa12e44").Return(ds.ErrBusy)
+	lr := &LoginRequest{UserName: "carol", UnixTimeStamp: 1483250400, IpAddress: "82.233.123.117",
+		EventUUID: "85ad929a-db03-4bf4-9541-8f728fa12e43"}
+	assert.Nil(t, storeLogin(context.Background(), 0, "cached", testObj, lr, &LoginInfo{}, nil, nil, lr.IpAddress))
+	latest, ok := latestLogins.get("cached", "carol")
+	if assert.True(t, ok) {
+		assert.Equal(t, int64(1483250400), latest.TimeStamp, "A stored login should become the cached latest")
+	}
+
+	failed := *lr
+	failed.UnixTimeStamp, failed.EventUUID = 1483254000, "85ad929a-db03-4bf4-9541-8f728fa12e44"
+	stageErr := storeLogin(context.Background(), 0, "cached", testObj, &failed, &LoginInfo{}, nil, nil, lr.IpAddress)
+	if assert.NotNil(t, stageErr) {
+		assert.Equal(t, 503, stageErr.Status)
+	}
+	_, ok = latestLogins.get("cached", "carol")
+	assert.False(t, ok, "A failed persist may still commit, so the next login should read the datastore")
+	testObj.AssertExpectations(t)
+}
+
+func TestLatestLoginCache(t *testing.T) {
+	c := newLatestLoginCache(2)
+	c.advance("t", "bob", "e2", Events{TimeStamp: 200})
+	c.advance("t", "bob", "e1", Events{TimeStamp: 100})
+	latest, ok := c.get("t", "bob")
+	assert.True(t, ok)
+	assert.Equal(t, int64(200), latest.TimeStamp, "An older login should not replace the latest")
+	_, ok = c.get("other", "bob")
+	assert.False(t, ok, "Users should be cached per tenant")
+
+	c.advance("t", "alice", "e3", Events{TimeStamp: 300})
+	c.get("t", "bob")
+	c.advance("t", "carol", "e4", Events{TimeStamp: 400})
+	_, ok = c.get("t", "alice")
+	assert.False(t, ok, "The least recently active user should be dropped")
+
+	c.removeEvent("t", "e2")
+	_, ok = c.get("t", "bob")
+	assert.False(t, ok, "Deleting the latest login should drop the user")
+	c.expire(500)
+	_, ok = c.get("t", "carol")
+	assert.False(t, ok, "Logins older than the retention cutoff should be dropped")
+
+	c.configure(0, 0)
+	c.advance("t", "bob", "e5", Events{TimeStamp: 500})
+	_, ok = c.get("t", "bob")
+	assert.False(t, ok, "A cache of size zero should hold nothing")
+}
+
+func TestLatestLoginCacheExpires(t *testing.T) {
+	c := newLatestLoginCache(2)
+	c.configure(2, 20*time.Millisecond)
+	c.advance("t", "bob", "e1", Events{TimeStamp: 100})
+	_, ok := c.get("t", "bob")
+	assert.True(t, ok)
+	time.Sleep(30 * time.Millisecond)
+	_, ok = c.get("t", "bob")
+	assert.False(t, ok, "A login cached past the ttl should be read from the datastore again")
+}
+
+func TestUserLocksSerialiseLoginsOfAUser(t *testing.T) {
+	locks := &userLocks{locks: make(map[latestKey]*userLock)}
+	unlock, err := locks.lock(context.Background(), "t", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := locks.lock(context.Background(), "t", "alice")
+	assert.Nil(t, err, "Other users should not wait")
+	other()
+
+	timeout, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = locks.lock(timeout, "t", "bob")
+	assert.Equal(t, context.DeadlineExceeded, err, "A second login of the user should wait for the first")
+
+	acquired := make(chan func())
+	go func() {
+		next, _ := locks.lock(context.Background(), "t", "bob")
+		acquired <- next
+	}()
+	unlock()
+	(<-acquired)()
+
+	unlock, err = locks.lock(context.Background(), "t", "bob-current", "bob-old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = locks.lock(timeout, "t", "bob-old")
+	assert.Equal(t, context.DeadlineExceeded, err, "Every username of the user should be locked")
+	unlock()
+	assert.Empty(t, locks.locks, "The locks of users no login waits for should be dropped")
+}
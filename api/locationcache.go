@@ -0,0 +1,230 @@
+package api
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	ds "github.com/anyaddres/supermann/datastore"
+)
+
+// Reasons cached locations are evicted for.
+const (
+	evictedSize    = "size"
+	evictedExpired = "expired"
+	evictedReload  = "reload"
+)
+
+// LocationCache represents the Ip to Location Map for faster retrieval. Each tenant has its
+// own entries. It holds at most size entries, dropping the least recently used first, and entries
+// expire after the ttl. The entries are dropped when the GeoIP database is reloaded.
+type LocationCache struct {
+	mutex sync.Mutex
+	size  int
+	ttl   time.Duration
+	// byNetwork caches locations under the network the GeoIP database has them for.
+	byNetwork bool
+	entries   map[locationKey]*list.Element
+	// recent holds the entries, the most recently used first.
+	recent *list.List
+	// prefixes counts the cached networks by their mask, which are the masks a lookup tries.
+	prefixes map[prefixMask]int
+	// generation is that of the GeoIP database the cached locations came from.
+	generation uint64
+	now        func() time.Time
+}
+
+// locationKey is the ip address of a cached location, or its network in CIDR notation.
+type locationKey struct {
+	tenant string
+	ip     string
+}
+
+type prefixMask struct {
+	ones, bits int
+}
+
+type locationEntry struct {
+	key     locationKey
+	network *net.IPNet
+	rec     *LoginInfo
+	expires time.Time
+}
+
+// locationCache is configured by NewServer.
+var locationCache = newLocationCache(100000, 24*time.Hour, false)
+
+func newLocationCache(size int, ttl time.Duration, byNetwork bool) *LocationCache {
+	return &LocationCache{size: size, ttl: ttl, byNetwork: byNetwork, entries: make(map[locationKey]*list.Element),
+		recent: list.New(), prefixes: make(map[prefixMask]int), now: time.Now}
+}
+
+// configure changes the bounds of the cache, evicting the entries past the new size.
+func (lc *LocationCache) configure(size int, ttl time.Duration, byNetwork bool) {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	lc.size, lc.ttl, lc.byNetwork = size, ttl, byNetwork
+	for lc.recent.Len() > max(size, 0) {
+		lc.evict(lc.recent.Back(), evictedSize)
+	}
+}
+
+// get returns the cached location of ip, found either by the address or by a cached network
+// containing it.
+func (lc *LocationCache) get(tenant, ip string) (*LoginInfo, bool) {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	if rec, ok := lc.lookup(locationKey{tenant: tenant, ip: ip}); ok {
+		return rec, true
+	}
+	if len(lc.prefixes) == 0 {
+		return nil, false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, false
+	}
+	// The networks cached from a database never locate an address differently, whichever contains
+	// it is as good as any.
+	for prefix := range lc.prefixes {
+		addr := parsed
+		if prefix.bits == net.IPv4len*8 {
+			if addr = parsed.To4(); addr == nil {
+				continue
+			}
+		}
+		mask := net.CIDRMask(prefix.ones, prefix.bits)
+		network := &net.IPNet{IP: addr.Mask(mask), Mask: mask}
+		if rec, ok := lc.lookup(locationKey{tenant: tenant, ip: network.String()}); ok {
+			return rec, true
+		}
+	}
+	return nil, false
+}
+
+// lookup returns the entry of key unless it expired, marking it the most recently used.
+func (lc *LocationCache) lookup(key locationKey) (*LoginInfo, bool) {
+	element, ok := lc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*locationEntry)
+	if !entry.expires.IsZero() && !lc.now().Before(entry.expires) {
+		lc.evict(element, evictedExpired)
+		return nil, false
+	}
+	lc.recent.MoveToFront(element)
+	return entry.rec, true
+}
+
+// store caches the location of ip, under its network when caching by network and the database
+// told it, unless the GeoIP database it came from was replaced in the meantime.
+func (lc *LocationCache) store(tenant, ip string, network *net.IPNet, rec *LoginInfo, generation uint64) {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	if lc.generation != generation || lc.size <= 0 {
+		return
+	}
+	if !lc.byNetwork {
+		network = nil
+	}
+	key := locationKey{tenant: tenant, ip: ip}
+	if network != nil {
+		key.ip = network.String()
+	}
+	entry := &locationEntry{key: key, network: network, rec: rec}
+	if lc.ttl > 0 {
+		entry.expires = lc.now().Add(lc.ttl)
+	}
+	if element, ok := lc.entries[key]; ok {
+		element.Value = entry
+		lc.recent.MoveToFront(element)
+		return
+	}
+	lc.entries[key] = lc.recent.PushFront(entry)
+	if network != nil {
+		ones, bits := network.Mask.Size()
+		lc.prefixes[prefixMask{ones, bits}]++
+	}
+	for lc.recent.Len() > lc.size {
+		lc.evict(lc.recent.Back(), evictedSize)
+	}
+}
+
+// evict drops an entry, counting it under reason. Entries removed on request are not evictions.
+func (lc *LocationCache) evict(element *list.Element, reason string) {
+	lc.delete(element)
+	locationCacheEvictions.With(reason).Inc()
+}
+
+func (lc *LocationCache) delete(element *list.Element) {
+	entry := lc.recent.Remove(element).(*locationEntry)
+	delete(lc.entries, entry.key)
+	if entry.network != nil {
+		ones, bits := entry.network.Mask.Size()
+		prefix := prefixMask{ones, bits}
+		if lc.prefixes[prefix]--; lc.prefixes[prefix] == 0 {
+			delete(lc.prefixes, prefix)
+		}
+	}
+}
+
+// remove drops the cached locations of the given ip addresses and returns how many were cached.
+// Truncated networks, as stored when ip addresses are pseudonymised, remove every cached ip address
+// within them. Cached networks containing any of the addresses are removed too.
+func (lc *LocationCache) remove(tenant string, ipAddresses []string) int {
+	remove := make(map[string]bool, len(ipAddresses))
+	var addresses []net.IP
+	for _, ip := range ipAddresses {
+		remove[ip] = true
+		if parsed := net.ParseIP(ip); parsed != nil {
+			addresses = append(addresses, parsed)
+		}
+	}
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	removed := 0
+	for key, element := range lc.entries {
+		if key.tenant != tenant {
+			continue
+		}
+		entry := element.Value.(*locationEntry)
+		drop := remove[key.ip] || remove[ds.TruncateIP(key.ip)]
+		if entry.network != nil {
+			drop = remove[ds.TruncateIP(entry.network.IP.String())]
+			for _, addr := range addresses {
+				drop = drop || entry.network.Contains(addr)
+			}
+		}
+		if drop {
+			lc.delete(element)
+			removed++
+		}
+	}
+	return removed
+}
+
+// sync drops every cached location when the GeoIP database was reloaded since they were cached.
+func (lc *LocationCache) sync(generation uint64) {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	if lc.generation >= generation {
+		return
+	}
+	if n := lc.recent.Len(); n > 0 {
+		locationCacheEvictions.With(evictedReload).Add(float64(n))
+	}
+	lc.entries = make(map[locationKey]*list.Element)
+	lc.recent.Init()
+	lc.prefixes = make(map[prefixMask]int)
+	lc.generation = generation
+}
+
+// len returns the number of cached locations, expired ones included until they are looked up or
+// pushed out.
+func (lc *LocationCache) len() int {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	return lc.recent.Len()
+}
@@ -0,0 +1,235 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ds "github.com/anyaddres/supermann/datastore"
+	"github.com/anyaddres/supermann/geoip"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocationCacheDroppedOnReload(t *testing.T) {
+	lc := newLocationCache(10, 0, false)
+	lc.sync(1)
+	lc.store(ds.DefaultTenant, "123.192.212.224", nil, &LoginInfo{Radius: 5}, 1)
+	assert.Equal(t, 1, lc.len(), "A location from the current database should be cached")
+
+	lc.sync(2)
+	assert.Equal(t, 0, lc.len(), "Reloading the database should drop the cached locations")
+	lc.store(ds.DefaultTenant, "123.192.212.224", nil, &LoginInfo{Radius: 5}, 1)
+	assert.Equal(t, 0, lc.len(), "A location from the replaced database should not be cached")
+}
+
+func TestLocationCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	lc := newLocationCache(3, 0, false)
+	for i := 1; i <= 3; i++ {
+		lc.store("t", fmt.Sprintf("10.0.0.%d", i), nil, &LoginInfo{Radius: uint16(i)}, 0)
+	}
+	_, ok := lc.get("t", "10.0.0.1")
+	assert.True(t, ok)
+	before := locationCacheEvictions.With(evictedSize).Value()
+	lc.store("t", "10.0.0.4", nil, &LoginInfo{Radius: 4}, 0)
+	assert.Equal(t, 3, lc.len(), "The cache should not grow past its size")
+	assert.Equal(t, before+1, locationCacheEvictions.With(evictedSize).Value())
+	_, ok = lc.get("t", "10.0.0.2")
+	assert.False(t, ok, "The least recently used location should be evicted")
+	_, ok = lc.get("t", "10.0.0.1")
+	assert.True(t, ok, "A location looked up since should be kept")
+
+	lc.configure(1, 0, false)
+	assert.Equal(t, 1, lc.len(), "Shrinking the cache should evict the entries past its size")
+	lc.configure(0, 0, false)
+	lc.store("t", "10.0.0.5", nil, &LoginInfo{}, 0)
+	assert.Equal(t, 0, lc.len(), "A cache of size zero should hold nothing")
+}
+
+func TestLocationCacheExpires(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	lc := newLocationCache(10, time.Hour, false)
+	lc.now = func() time.Time { return now }
+	lc.store("t", "10.0.0.1", nil, &LoginInfo{Radius: 1}, 0)
+	now = now.Add(59 * time.Minute)
+	_, ok := lc.get("t", "10.0.0.1")
+	assert.True(t, ok)
+	now = now.Add(time.Minute)
+	_, ok = lc.get("t", "10.0.0.1")
+	assert.False(t, ok, "A location should expire after the ttl")
+	assert.Equal(t, 0, lc.len(), "An expired location should be evicted")
+}
+
+func TestLocationCacheByNetwork(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.1.0.0/16")
+	lc := newLocationCache(10, 0, true)
+	lc.store("t", "10.1.2.3", network, &LoginInfo{Radius: 16}, 0)
+	rec, ok := lc.get("t", "10.1.200.7")
+	assert.True(t, ok, "Addresses within a cached network should be found")
+	assert.Equal(t, uint16(16), rec.Radius)
+	_, ok = lc.get("t", "10.2.0.1")
+	assert.False(t, ok)
+	_, ok = lc.get("other", "10.1.2.3")
+	assert.False(t, ok, "Networks should be cached per tenant")
+	_, ok = lc.get("t", "::ffff:10.1.9.9")
+	assert.True(t, ok, "IPv4 mapped addresses should be found in IPv4 networks")
+
+	assert.Equal(t, 1, lc.remove("t", []string{"10.1.99.1"}), "Erasing an address should remove its network")
+	_, ok = lc.get("t", "10.1.2.3")
+	assert.False(t, ok)
+	assert.Empty(t, lc.prefixes)
+
+	lc.configure(10, 0, false)
+	lc.store("t", "10.1.2.3", network, &LoginInfo{}, 0)
+	_, ok = lc.get("t", "10.1.2.4")
+	assert.False(t, ok, "Networks should only be cached when enabled")
+}
+
+// mmdbNode is a node of the search tree of an mmdb database. Each side leads to a node or to the
+// data of a network, at data offset minus one, or to nothing.
+type mmdbNode struct {
+	child [2]*mmdbNode
+	data  [2]int
+}
+
+// mmdbValue encodes a value of the MaxMind DB data section: a map, a string or a number.
+func mmdbValue(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		buf.WriteByte(7<<5 | byte(len(v)))
+		for key, value := range v {
+			mmdbValue(buf, key)
+			mmdbValue(buf, value)
+		}
+	case string:
+		buf.WriteByte(2<<5 | byte(len(v)))
+		buf.WriteString(v)
+	case float64:
+		buf.WriteByte(3<<5 | 8)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case uint16:
+		buf.WriteByte(5<<5 | 2)
+		binary.Write(buf, binary.BigEndian, v)
+	case uint32:
+		buf.WriteByte(6<<5 | 4)
+		binary.Write(buf, binary.BigEndian, v)
+	case uint64:
+		buf.Write([]byte{8, 9 - 7})
+		binary.Write(buf, binary.BigEndian, v)
+	}
+}
+
+// writeMaxMindDB writes an IPv4 City database with 24 bit records holding the records of the
+// networks, and returns its path.
+func writeMaxMindDB(t *testing.T, networks map[string]map[string]interface{}) string {
+	root := &mmdbNode{}
+	var data bytes.Buffer
+	for cidr, record := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := network.Mask.Size()
+		node, ip := root, network.IP.To4()
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - uint(i%8)) & 1
+			if i == ones-1 {
+				node.data[bit] = data.Len() + 1
+				break
+			}
+			if node.child[bit] == nil {
+				node.child[bit] = &mmdbNode{}
+			}
+			node = node.child[bit]
+		}
+		mmdbValue(&data, record)
+	}
+	nodes := []*mmdbNode{root}
+	for i := 0; i < len(nodes); i++ {
+		for _, child := range nodes[i].child {
+			if child != nil {
+				nodes = append(nodes, child)
+			}
+		}
+	}
+	index := make(map[*mmdbNode]int)
+	for i, node := range nodes {
+		index[node] = i
+	}
+	var file bytes.Buffer
+	for _, node := range nodes {
+		for side := range node.child {
+			record := len(nodes)
+			if node.child[side] != nil {
+				record = index[node.child[side]]
+			} else if node.data[side] != 0 {
+				record = len(nodes) + 16 + node.data[side] - 1
+			}
+			file.Write([]byte{byte(record >> 16), byte(record >> 8), byte(record)})
+		}
+	}
+	file.Write(make([]byte, 16))
+	file.Write(data.Bytes())
+	file.WriteString("\xab\xcd\xefMaxMind.com")
+	mmdbValue(&file, map[string]interface{}{"node_count": uint32(len(nodes)), "record_size": uint16(24),
+		"ip_version": uint16(4), "database_type": "GeoLite2-City", "binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0), "build_epoch": uint64(1790812800)})
+	path := filepath.Join(t.TempDir(), "GeoLite2-City.mmdb")
+	if err := os.WriteFile(path, file.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLocationCacheByMaxMindNetwork(t *testing.T) {
+	city := func(name string, lat, lon float64) map[string]interface{} {
+		return map[string]interface{}{
+			"city":     map[string]interface{}{"names": map[string]interface{}{"en": name}},
+			"location": map[string]interface{}{"latitude": lat, "longitude": lon, "accuracy_radius": uint16(20)},
+		}
+	}
+	path := writeMaxMindDB(t, map[string]map[string]interface{}{
+		"1.0.0.0/24":   city("Los Angeles", 34.05223, -118.24368),
+		"1.0.1.0/25":   city("Fuzhou", 26.06139, 119.30611),
+		"81.2.69.0/23": city("London", 51.5142, -0.0931)})
+	p, err := geoip.OpenProvider(geoip.SourceSpec{Kind: geoip.KindMaxMind, Path: path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	loc, err := p.Lookup(context.Background(), net.ParseIP("1.0.1.17"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Fuzhou", loc.City)
+	if assert.NotNil(t, loc.Network, "MaxMind locations should tell the network of their record") {
+		assert.Equal(t, "1.0.1.0/25", loc.Network.String())
+	}
+	_, err = p.Lookup(context.Background(), net.ParseIP("1.0.1.128"))
+	assert.Equal(t, geoip.ErrNotFound, err)
+
+	lc := newLocationCache(10, 0, true)
+	lc.store("t", "1.0.1.17", loc.Network, &LoginInfo{Radius: loc.AccuracyRadius}, 0)
+	rec, ok := lc.get("t", "1.0.1.100")
+	assert.True(t, ok, "Addresses within the network of a MaxMind record should be found")
+	assert.Equal(t, uint16(20), rec.Radius)
+	_, ok = lc.get("t", "1.0.1.200")
+	assert.False(t, ok, "Addresses outside the network of the record should be looked up")
+}
+
+func TestLocationCacheRemove(t *testing.T) {
+	lc := newLocationCache(10, 0, false)
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.1.1"} {
+		lc.store("t", ip, nil, &LoginInfo{}, 0)
+		lc.store("other", ip, nil, &LoginInfo{}, 0)
+	}
+	assert.Equal(t, 2, lc.remove("t", []string{"10.0.0.0"}), "A truncated network should remove the addresses within")
+	assert.Equal(t, 4, lc.len(), "The locations of other tenants should be kept")
+}
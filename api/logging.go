@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"github.com/anyaddres/supermann/logging"
+)
+
+// RequestIDHeader carries the id of a request. The id sent by the caller is kept when it is valid,
+// otherwise one is generated. It is returned in the response and logged with every record of the
+// request.
+const RequestIDHeader = "X-Request-ID"
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// LogLevel is the request and response of the log level admin route.
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+// requestIDHandler puts the request id in the context of the request.
+type requestIDHandler struct {
+	next http.Handler
+}
+
+func (h *requestIDHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	id := req.Header.Get(RequestIDHeader)
+	if !requestIDPattern.MatchString(id) {
+		id = logging.NewRequestID()
+	}
+	writer.Header().Set(RequestIDHeader, id)
+	h.next.ServeHTTP(writer, req.WithContext(logging.WithRequestID(req.Context(), id)))
+}
+
+// logLevel returns the current log level and changes it on PUT.
+func logLevel(ctx *SrvContext, w http.ResponseWriter, r *http.Request) (interface{}, *apiErr) {
+	if r.Method == "PUT" {
+		var level LogLevel
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, newBodyReadErr(err)
+		}
+		if err = json.Unmarshal(data, &level); err == nil {
+			err = logging.SetLevel(level.Level)
+		}
+		if err != nil {
+			errs := url.Values{}
+			errs.Add("Level", err.Error())
+			return nil, newInvalidArgumentErr(errs)
+		}
+		slog.InfoContext(r.Context(), "log level changed", "level", logging.Level(), "client", clientFrom(r).ID)
+	}
+	return &LogLevel{Level: logging.Level()}, nil
+}
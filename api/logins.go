@@ -1,6 +1,8 @@
 package api
 
 import (
+	"context"
+
 	ds "github.com/anyaddres/supermann/datastore"
 )
 
@@ -24,11 +26,27 @@ type Location struct {
 	Lon float64 `json:"lon,omitempty"`
 }
 
-// LoginInfo struct that includes the Location and also the Accuracy radius and speed
+// LoginInfo struct that includes the Location and also the Accuracy radius and speed. Locations
+// taken from the GeoIP overrides have the override source and the label of their range.
 type LoginInfo struct {
 	Location
 	Radius uint16  `json:"radius,omitempty"`
 	Speed  float64 `json:"speed,omitempty"`
+	Place
+	Source string `json:"source,omitempty"`
+	Label  string `json:"label,omitempty"`
+}
+
+// Place names where a login came from, in the configured GeoIP language. Country and Subdivision
+// are ISO 3166 codes. The fields the GeoIP database does not have are left out.
+type Place struct {
+	Country         string `json:"country,omitempty"`
+	CountryName     string `json:"countryName,omitempty"`
+	Subdivision     string `json:"subdivision,omitempty"`
+	SubdivisionName string `json:"subdivisionName,omitempty"`
+	City            string `json:"city,omitempty"`
+	PostalCode      string `json:"postalCode,omitempty"`
+	TimeZone        string `json:"timeZone,omitempty"`
 }
 
 type LoginEntry struct {
@@ -37,6 +55,7 @@ type LoginEntry struct {
 }
 
 type Events struct {
+	id int64
 	LoginInfo
 	Ip               string `json:"ip,omitempty"`
 	TimeStamp        int64  `json:"timestamp,omitempty"`
@@ -50,10 +69,20 @@ type Response struct {
 }
 
 type LoginStore interface {
-	InsertLogin(loginEntry *ds.LoginEntryDAO) error
-	GetLoginsForUserGreaterThanOrLessThan(loginID string, operator string, ts int64) (*[]ds.LoginEntryDAO, error)
+	InsertLogin(ctx context.Context, loginEntry *ds.LoginEntryDAO) error
+	UpdateLoginSpeed(ctx context.Context, id int64, speed float64) error
+	GetLoginsForUserGreaterThanOrLessThan(ctx context.Context, loginID string, operator string, ts int64) (*[]ds.LoginEntryDAO, error)
 }
 
 type Searcher interface {
-	GetLoginsForUserGreaterThanOrLessThan(username, operator string, ts int64) (*[]ds.LoginEntryDAO, error)
+	GetLoginsForUserGreaterThanOrLessThan(ctx context.Context, username, operator string, ts int64) (*[]ds.LoginEntryDAO, error)
+}
+
+// EventStore is used to look up and remove a single login event. The neighbours of an event read
+// back are looked up by the username it is stored under, which is a pseudonym when usernames are
+// pseudonymised.
+type EventStore interface {
+	GetLoginByUUID(ctx context.Context, eventUUID string) (*ds.LoginEntryDAO, error)
+	GetLoginsNextTo(ctx context.Context, lg *ds.LoginEntryDAO, operator string, ts int64) (*[]ds.LoginEntryDAO, error)
+	DeleteLogin(ctx context.Context, id, next int64, nextSpeed float64) error
 }
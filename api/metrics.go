@@ -0,0 +1,103 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/anyaddres/supermann/logging"
+	"github.com/anyaddres/supermann/metrics"
+)
+
+var (
+	httpRequests = metrics.NewCounterVec("superman_http_requests_total",
+		"Requests served by route, method and status.", "route", "method", "status")
+	httpDuration = metrics.NewHistogramVec("superman_http_request_duration_seconds",
+		"Time taken to serve requests by route, method and status.", metrics.DefBuckets, "route", "method", "status")
+	geoipDuration = metrics.NewHistogramVec("superman_geoip_lookup_duration_seconds",
+		"Time taken by GeoIP database lookups.", metrics.DefBuckets)
+	// The location cache hit ratio is hits over all lookups.
+	locationCacheLookups = metrics.NewCounterVec("superman_location_cache_lookups_total",
+		"Location cache lookups by result, hit or miss.", "result")
+	locationCacheEvictions = metrics.NewCounterVec("superman_location_cache_evictions_total",
+		"Locations evicted from the cache by reason, size, expired or reload.", "reason")
+	_ = metrics.NewGaugeFunc("superman_location_cache_entries",
+		"Locations held in the cache.", func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(locationCache.len())}}
+		})
+	latestLoginLookups = metrics.NewCounterVec("superman_latest_login_cache_lookups_total",
+		"Latest login cache lookups by result, hit, miss or out_of_order for logins older than the cached one.",
+		"result")
+	loginsChecked = metrics.NewCounterVec("superman_logins_checked_total",
+		"Logins checked for suspicious travel.")
+	suspiciousVerdicts = metrics.NewCounterVec("superman_suspicious_verdicts_total",
+		"Suspicious verdicts by reason, travel from the preceding or to the subsequent login.", "reason")
+	stageTimeouts = metrics.NewCounterVec("superman_stage_timeouts_total",
+		"Request stages stopped by their deadline, by stage.", "stage")
+)
+
+const (
+	reasonPrecedingTravel  = "preceding_travel"
+	reasonSubsequentTravel = "subsequent_travel"
+)
+
+// recordVerdicts counts a checked login and logs and counts the reasons it was found suspicious
+// for.
+func recordVerdicts(ctx context.Context, entry *LoginRequest, prev, next *Events) {
+	loginsChecked.With().Inc()
+	var reasons []string
+	if prev != nil && prev.SuspiciousTravel {
+		reasons = append(reasons, reasonPrecedingTravel)
+	}
+	if next != nil && next.SuspiciousTravel {
+		reasons = append(reasons, reasonSubsequentTravel)
+	}
+	for _, reason := range reasons {
+		suspiciousVerdicts.With(reason).Inc()
+	}
+	if len(reasons) > 0 {
+		slog.InfoContext(ctx, "suspicious login", logging.KeyUser, entry.UserName, logging.KeyIP, entry.IpAddress,
+			"event_uuid", entry.EventUUID, "reasons", reasons)
+	}
+}
+
+// statusRecorder remembers the status code written to the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// metricsHandler counts and times every request, including those the other middleware rejects.
+type metricsHandler struct {
+	next http.Handler
+}
+
+func (h *metricsHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+	h.next.ServeHTTP(rec, req)
+	route, method := routeLabels(req)
+	status := strconv.Itoa(rec.status)
+	httpRequests.With(route, method, status).Inc()
+	httpDuration.With(route, method, status).Observe(time.Since(start).Seconds())
+}
+
+// routeLabels returns the route and method a request is recorded under. Unknown paths and methods
+// share a label so that scanners cannot blow up the number of series.
+func routeLabels(req *http.Request) (string, string) {
+	route, method := routeFor(req.URL.Path), req.Method
+	if _, ok := routeScopes[route][method]; !ok {
+		method = "other"
+	}
+	if _, ok := routeScopes[route]; !ok {
+		route = "other"
+	}
+	return string(route), method
+}
@@ -0,0 +1,31 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHandlerLabels(t *testing.T) {
+	handler := &metricsHandler{next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})}
+	before := httpRequests.With(string(EventByUUID), "GET", "404").Value()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/events/some-uuid", nil))
+	assert.Equal(t, before+1, httpRequests.With(string(EventByUUID), "GET", "404").Value(),
+		"Event routes should share the route label")
+
+	before = httpRequests.With("other", "other", "404").Value()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PROPFIND", "/wp-login.php", nil))
+	assert.Equal(t, before+1, httpRequests.With("other", "other", "404").Value(),
+		"Unknown routes and methods should share a label")
+}
+
+func TestRecordVerdicts(t *testing.T) {
+	before := suspiciousVerdicts.With(reasonSubsequentTravel).Value()
+	recordVerdicts(context.Background(), &LoginRequest{}, &Events{}, &Events{SuspiciousTravel: true})
+	assert.Equal(t, before+1, suspiciousVerdicts.With(reasonSubsequentTravel).Value())
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/anyaddres/supermann/metrics"
+)
+
+var (
+	rateLimitRequests = metrics.NewCounterVec("superman_ratelimit_requests_total",
+		"Requests checked against a rate limiter by limiter and result, allowed or limited.", "limiter", "result")
+	_ = metrics.NewGaugeFunc("superman_ratelimit_tokens",
+		"Tokens left in the bucket of each client or tenant that made a request recently.", rateLimitTokens,
+		"limiter", "key")
+
+	// rateLimiters holds the latest limiter created under each name, whose buckets are exposed.
+	rateLimiters = struct {
+		sync.Mutex
+		byName map[string]*rateLimiter
+	}{byName: make(map[string]*rateLimiter)}
+)
+
+// tokenBucket holds the tokens left to a client or tenant as of last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a set of token buckets, one per key, that refill at rate tokens per second up to
+// burst tokens. A request takes one token.
+type rateLimiter struct {
+	name  string
+	rate  float64
+	burst float64
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+	now     func() time.Time
+}
+
+func newRateLimiter(name string, rate float64, burst int) *rateLimiter {
+	l := newUnlistedRateLimiter(name, rate, burst)
+	rateLimiters.Lock()
+	rateLimiters.byName[name] = l
+	rateLimiters.Unlock()
+	return l
+}
+
+// newUnlistedRateLimiter returns a limiter whose buckets are not exposed, for keys such as ip
+// addresses that are not to be published.
+func newUnlistedRateLimiter(name string, rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &rateLimiter{name: name, rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket),
+		now: time.Now}
+}
+
+// allow takes a token from the bucket of key. When the bucket is empty it returns false along
+// with how long it takes for a token to become available.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	l.prune(now)
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		rateLimitRequests.With(l.name, "limited").Inc()
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	rateLimitRequests.With(l.name, "allowed").Inc()
+	return true, 0
+}
+
+// prune drops the buckets that have refilled completely, they are the same as a new bucket.
+func (l *rateLimiter) prune(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.pruned) < full {
+		return
+	}
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+	l.pruned = now
+}
+
+// state returns the tokens left in each bucket.
+func (l *rateLimiter) state() map[string]float64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	tokens := make(map[string]float64, len(l.buckets))
+	for key, bucket := range l.buckets {
+		tokens[key] = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	}
+	return tokens
+}
+
+func rateLimitTokens() []metrics.Sample {
+	rateLimiters.Lock()
+	limiters := make([]*rateLimiter, 0, len(rateLimiters.byName))
+	for _, l := range rateLimiters.byName {
+		limiters = append(limiters, l)
+	}
+	rateLimiters.Unlock()
+	var samples []metrics.Sample
+	for _, l := range limiters {
+		for key, tokens := range l.state() {
+			samples = append(samples, metrics.Sample{LabelValues: []string{l.name, key}, Value: tokens})
+		}
+	}
+	return samples
+}
+
+// rateLimit applies the per client and per tenant limits configured, in that order. With
+// authentication disabled every request is the anonymous client's, so the client limit would be
+// shared by all of them and is not applied. The per ip address limit stands in for it.
+func (s *Server) rateLimit(client *Client, tenant string) *apiErr {
+	if s.clientLimiter != nil && s.srvContext.cfg.AuthEnabled {
+		if ok, retry := s.clientLimiter.allow(client.ID); !ok {
+			return newTooManyRequestsErr(retry, "Rate limit of client %s exceeded", client.ID)
+		}
+	}
+	if s.tenantLimiter != nil {
+		if ok, retry := s.tenantLimiter.allow(tenant); !ok {
+			return newTooManyRequestsErr(retry, "Rate limit of tenant %s exceeded", tenant)
+		}
+	}
+	return nil
+}
+
+// rateLimitIP applies the per ip address limit configured to the address the request came from,
+// which is the address of the proxy for requests relayed by one.
+func (s *Server) rateLimitIP(req *http.Request) *apiErr {
+	if s.ipLimiter == nil {
+		return nil
+	}
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if ok, retry := s.ipLimiter.allow(ip); !ok {
+		return newTooManyRequestsErr(retry, "Rate limit of the client address exceeded")
+	}
+	return nil
+}
+
+// maxBodyHandler limits the size of request bodies before any other handler reads them.
+type maxBodyHandler struct {
+	maxBytes int64
+	next     http.Handler
+}
+
+func (h *maxBodyHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	if req.ContentLength > h.maxBytes {
+		writeErr(writer, newRequestTooLargeErr(h.maxBytes))
+		return
+	}
+	req.Body = http.MaxBytesReader(writer, req.Body, h.maxBytes)
+	h.next.ServeHTTP(writer, req)
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/anyaddres/supermann/config"
+	ds "github.com/anyaddres/supermann/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterRefills(t *testing.T) {
+	now := time.Unix(1483246800, 0)
+	limiter := newRateLimiter("test", 2, 2)
+	limiter.now = func() time.Time { return now }
+
+	ok, _ := limiter.allow("gateway")
+	assert.True(t, ok, "The first request of the burst should pass")
+	ok, _ = limiter.allow("gateway")
+	assert.True(t, ok, "The second request of the burst should pass")
+	ok, retry := limiter.allow("gateway")
+	assert.False(t, ok, "A request beyond the burst should be limited")
+	assert.Equal(t, 500*time.Millisecond, retry, "A token should be available after half a second")
+	ok, _ = limiter.allow("other")
+	assert.True(t, ok, "Other clients should have their own bucket")
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = limiter.allow("gateway")
+	assert.True(t, ok, "The bucket should have refilled a token")
+}
+
+func TestTooManyRequestsRetryAfter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeErr(rec, newTooManyRequestsErr(1500*time.Millisecond, "Rate limit of client %s exceeded", "gateway"))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"), "Retry-After should be rounded up to whole seconds")
+}
+
+func TestClientRateLimitNeedsAuthentication(t *testing.T) {
+	s := &Server{srvContext: &SrvContext{cfg: &config.Config{AuthEnabled: false}},
+		clientLimiter: newUnlistedRateLimiter("client", 1, 1)}
+	anonymous := &Client{ID: AnonymousClient, Scopes: Scopes}
+	assert.Nil(t, s.rateLimit(anonymous, ds.DefaultTenant))
+	assert.Nil(t, s.rateLimit(anonymous, ds.DefaultTenant), "Requests without authentication should not share a client limit")
+
+	s.srvContext.cfg.AuthEnabled = true
+	gateway := &Client{ID: "gateway", Scopes: Scopes}
+	assert.Nil(t, s.rateLimit(gateway, ds.DefaultTenant))
+	if err := s.rateLimit(gateway, ds.DefaultTenant); assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusTooManyRequests, err.Status, "Authenticated clients should be limited")
+	}
+}
+
+func TestIPRateLimitAppliesBeforeAuthentication(t *testing.T) {
+	s := &Server{srvContext: &SrvContext{cfg: &config.Config{AuthEnabled: true}},
+		ipLimiter: newUnlistedRateLimiter("ip", 1, 1)}
+	request := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/events/85ad929a-db03-4bf4-9541-8f728fa12e41", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		s.serve(EventByUUID, ScopeRead, rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, request("10.0.0.1:4000"))
+	assert.Equal(t, http.StatusTooManyRequests, request("10.0.0.1:4001"),
+		"Requests without a valid key should be limited by address before the key is looked up")
+	assert.Equal(t, http.StatusUnauthorized, request("10.0.0.2:4000"), "Other addresses should have their own bucket")
+	for _, sample := range rateLimitTokens() {
+		assert.NotEqual(t, "ip", sample.LabelValues[0], "The addresses should not be published")
+	}
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/anyaddres/supermann/config"
+	"github.com/anyaddres/supermann/logging"
+	"github.com/anyaddres/supermann/metrics"
+)
+
+const (
+	// RetentionBatchPause is the pause between two purge batches, which leaves the single
+	// database connection to the request handlers in between.
+	RetentionBatchPause = 100 * time.Millisecond
+)
+
+// Purger deletes logins that fall out of the retention window.
+type Purger interface {
+	PurgeLogins(ctx context.Context, cutoff int64, keepPerUser, batchSize int) (int64, error)
+}
+
+var (
+	retentionPurged = metrics.NewCounterVec("superman_retention_purged_total",
+		"Logins deleted by the retention purge.")
+	retentionBatches = metrics.NewCounterVec("superman_retention_batches_total",
+		"Batches run by the retention purge.")
+	retentionErrors = metrics.NewCounterVec("superman_retention_errors_total",
+		"Retention purges that failed.")
+	retentionRuns = metrics.NewCounterVec("superman_retention_runs_total",
+		"Retention purges run.")
+	retentionLastPurged = metrics.NewGaugeVec("superman_retention_last_run_purged",
+		"Logins deleted by the last retention purge.")
+	retentionLastRun = metrics.NewGaugeVec("superman_retention_last_run_timestamp_seconds",
+		"Unix time of the last retention purge.")
+)
+
+// retentionJob periodically purges the logins older than the configured retention window in
+// small batches.
+type retentionJob struct {
+	db          Purger
+	maxAge      time.Duration
+	keepPerUser int
+	batchSize   int
+	interval    time.Duration
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// newRetentionJob returns the purge configured in cfg. It rejects an interval or a batch size that is
+// not positive, which would stop the ticker from starting or never let a purge finish.
+func newRetentionJob(db Purger, cfg *config.Config) (*retentionJob, error) {
+	if cfg.RetentionInterval <= 0 {
+		return nil, fmt.Errorf("RETENTION_INTERVAL must be positive, got %s", cfg.RetentionInterval)
+	}
+	if cfg.RetentionBatchSize <= 0 {
+		return nil, fmt.Errorf("RETENTION_BATCH_SIZE must be positive, got %d", cfg.RetentionBatchSize)
+	}
+	return &retentionJob{
+		db:          db,
+		maxAge:      time.Duration(cfg.RetentionDays) * 24 * time.Hour,
+		keepPerUser: cfg.RetentionMinEvents,
+		batchSize:   cfg.RetentionBatchSize,
+		interval:    cfg.RetentionInterval,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}, nil
+}
+
+// StartRetention starts the background purge of old logins. It does nothing when no retention
+// window is configured, and fails when the purge is misconfigured.
+func (s *Server) StartRetention() error {
+	cfg := s.srvContext.cfg
+	if cfg.RetentionDays <= 0 || s.retention != nil {
+		return nil
+	}
+	job, err := newRetentionJob(s.srvContext.db, cfg)
+	if err != nil {
+		return err
+	}
+	s.retention = job
+	go s.retention.run()
+	return nil
+}
+
+// StopRetention stops the background purge and waits for a running batch to finish.
+func (s *Server) StopRetention() {
+	if s.retention == nil {
+		return
+	}
+	close(s.retention.stop)
+	<-s.retention.done
+	s.retention = nil
+}
+
+func (j *retentionJob) run() {
+	defer close(j.done)
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		j.purge(time.Now())
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purge deletes batches until nothing older than the retention window is left or the job is
+// stopped.
+func (j *retentionJob) purge(now time.Time) {
+	cutoff := now.Add(-j.maxAge).Unix()
+	start := time.Now()
+	var total int64
+	for {
+		purged, err := j.db.PurgeLogins(context.Background(), cutoff, j.keepPerUser, j.batchSize)
+		if err != nil {
+			slog.Error("retention purge failed", logging.KeyError, err)
+			retentionErrors.With().Inc()
+			break
+		}
+		total += purged
+		if purged > 0 && j.keepPerUser == 0 {
+			// The latest login of a user is only kept when logins are kept per user.
+			latestLogins.expire(cutoff)
+		}
+		retentionPurged.With().Add(float64(purged))
+		retentionBatches.With().Inc()
+		if purged < int64(j.batchSize) {
+			break
+		}
+		select {
+		case <-j.stop:
+			return
+		case <-time.After(RetentionBatchPause):
+		}
+	}
+	retentionRuns.With().Inc()
+	retentionLastPurged.With().Set(float64(total))
+	retentionLastRun.With().Set(float64(now.Unix()))
+	slog.Info("retention purge finished", "purged", total, "cutoff", time.Unix(cutoff, 0).UTC(), logging.Took(start))
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/anyaddres/supermann/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// batchPurger purges the logins it is given in batches, counting the batches run.
+type batchPurger struct {
+	left    int64
+	batches int
+}
+
+func (p *batchPurger) PurgeLogins(ctx context.Context, cutoff int64, keepPerUser, batchSize int) (int64, error) {
+	p.batches++
+	purged := min(p.left, int64(batchSize))
+	p.left -= purged
+	return purged, nil
+}
+
+func TestNewRetentionJobRejectsNonPositiveSettings(t *testing.T) {
+	cfg := &config.Config{RetentionDays: 30, RetentionBatchSize: 500, RetentionInterval: time.Hour}
+	_, err := newRetentionJob(&batchPurger{}, cfg)
+	assert.Nil(t, err)
+
+	zeroInterval := *cfg
+	zeroInterval.RetentionInterval = 0
+	_, err = newRetentionJob(&batchPurger{}, &zeroInterval)
+	assert.NotNil(t, err, "A zero interval would panic the ticker")
+
+	zeroBatch := *cfg
+	zeroBatch.RetentionBatchSize = 0
+	_, err = newRetentionJob(&batchPurger{}, &zeroBatch)
+	assert.NotNil(t, err, "A zero batch size would never finish a purge")
+
+	negativeBatch := *cfg
+	negativeBatch.RetentionBatchSize = -1
+	_, err = newRetentionJob(&batchPurger{}, &negativeBatch)
+	assert.NotNil(t, err)
+}
+
+func TestRetentionPurgeStopsAtShortBatch(t *testing.T) {
+	purger := &batchPurger{left: 5}
+	job, err := newRetentionJob(purger, &config.Config{RetentionDays: 30, RetentionMinEvents: 1, RetentionBatchSize: 2,
+		RetentionInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.purge(time.Now())
+	assert.Equal(t, int64(0), purger.left)
+	assert.Equal(t, 3, purger.batches, "The purge should stop after the first batch short of the batch size")
+}
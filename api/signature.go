@@ -0,0 +1,95 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anyaddres/supermann/signing"
+)
+
+// signatureVerifier rejects requests that are unsigned, signed outside the replay window or
+// whose signature has been seen before, and passes the others on to next. The signature covers the
+// nonce of the request, so only identical requests without a nonce share one.
+type signatureVerifier struct {
+	secret []byte
+	window time.Duration
+	next   http.Handler
+
+	mutex sync.Mutex
+	// seen holds the signatures verified within the window along with when they expire.
+	seen  map[string]time.Time
+	swept time.Time
+	now   func() time.Time
+}
+
+func newSignatureVerifier(secret string, window time.Duration, next http.Handler) *signatureVerifier {
+	return &signatureVerifier{secret: []byte(secret), window: window, next: next,
+		seen: make(map[string]time.Time), now: time.Now}
+}
+
+func (v *signatureVerifier) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	if err := v.verify(req); err != nil {
+		writeErr(writer, err)
+		return
+	}
+	v.next.ServeHTTP(writer, req)
+}
+
+func (v *signatureVerifier) verify(req *http.Request) *apiErr {
+	signature := req.Header.Get(signing.HeaderSignature)
+	timestamp := req.Header.Get(signing.HeaderTimestamp)
+	if signature == "" || timestamp == "" {
+		return newInvalidSignatureErr("Request is not signed")
+	}
+	// The signature is remembered as the MAC it encodes, so that the same MAC sent in another case
+	// is recognised as a replay.
+	mac, err := hex.DecodeString(signature)
+	if err != nil || len(mac) != sha256.Size {
+		return newInvalidSignatureErr("Malformed signature")
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return newInvalidSignatureErr("Malformed signature timestamp %s", timestamp)
+	}
+	now := v.now()
+	signedAt := time.Unix(ts, 0)
+	if signedAt.Before(now.Add(-v.window)) || signedAt.After(now.Add(v.window)) {
+		return newInvalidSignatureErr("Signature timestamp is outside the %s window", v.window)
+	}
+	body, err := signing.ReadBody(req)
+	if err != nil {
+		return newBodyReadErr(err)
+	}
+	nonce := req.Header.Get(signing.HeaderNonce)
+	if !signing.Valid(v.secret, req.Method, req.RequestURI, ts, nonce, body, signature) {
+		return newInvalidSignatureErr("Signature does not match the request")
+	}
+	if v.replayed(string(mac), signedAt, now) {
+		return newInvalidSignatureErr("Request has already been received")
+	}
+	return nil
+}
+
+// replayed records the MAC of a signature and reports whether it was already recorded. A signature only
+// has to be remembered until its timestamp leaves the window, after that it is rejected as stale.
+func (v *signatureVerifier) replayed(signature string, signedAt, now time.Time) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if now.Sub(v.swept) > v.window {
+		for sig, expires := range v.seen {
+			if expires.Before(now) {
+				delete(v.seen, sig)
+			}
+		}
+		v.swept = now
+	}
+	if expires, ok := v.seen[signature]; ok && !expires.Before(now) {
+		return true
+	}
+	v.seen[signature] = signedAt.Add(v.window)
+	return false
+}
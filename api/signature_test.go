@@ -0,0 +1,91 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anyaddres/supermann/signing"
+	"github.com/stretchr/testify/assert"
+)
+
+func signedRequest(t *testing.T, secret string, signedAt time.Time) *http.Request {
+	body := []byte(`{"username": "bob", "unix_timestamp": 590729457}`)
+	req := httptest.NewRequest("POST", "/api/identifylogins/", bytes.NewReader(body))
+	if err := signing.Sign(req, []byte(secret), signedAt); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// resent returns a copy of the request with the same headers and body, as a replay would send it.
+func resent(req *http.Request) *http.Request {
+	body, _ := signing.ReadBody(req)
+	copied := httptest.NewRequest(req.Method, req.RequestURI, bytes.NewReader(body))
+	copied.Header = req.Header.Clone()
+	return copied
+}
+
+func TestSignatureVerifier(t *testing.T) {
+	now := time.Unix(1483246800, 0)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	verifier := newSignatureVerifier("shared-secret", 5*time.Minute, next)
+	verifier.now = func() time.Time { return now }
+
+	req := signedRequest(t, "shared-secret", now.Add(-time.Minute))
+	rec := httptest.NewRecorder()
+	verifier.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code, "A freshly signed request should pass")
+
+	rec = httptest.NewRecorder()
+	verifier.ServeHTTP(rec, resent(req))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "A replayed request should be rejected")
+
+	upper := resent(req)
+	upper.Header.Set(signing.HeaderSignature, strings.ToUpper(req.Header.Get(signing.HeaderSignature)))
+	rec = httptest.NewRecorder()
+	verifier.ServeHTTP(rec, upper)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "A replay with the signature in upper case should be rejected")
+
+	malformed := resent(signedRequest(t, "shared-secret", now))
+	malformed.Header.Set(signing.HeaderSignature, malformed.Header.Get(signing.HeaderSignature)+"00")
+	rec = httptest.NewRecorder()
+	verifier.ServeHTTP(rec, malformed)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "A signature of the wrong length should be rejected")
+
+	rec = httptest.NewRecorder()
+	verifier.ServeHTTP(rec, signedRequest(t, "shared-secret", now.Add(-time.Minute)))
+	assert.Equal(t, http.StatusOK, rec.Code, "An identical request signed in the same second should pass")
+
+	tampered := resent(signedRequest(t, "shared-secret", now))
+	tampered.Header.Set(signing.HeaderNonce, "another")
+	rec = httptest.NewRecorder()
+	verifier.ServeHTTP(rec, tampered)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "A request with a changed nonce should be rejected")
+
+	withoutNonce := resent(signedRequest(t, "shared-secret", now))
+	withoutNonce.Header.Del(signing.HeaderNonce)
+	withoutNonce.Header.Set(signing.HeaderSignature, signing.Signature([]byte("shared-secret"), "POST",
+		"/api/identifylogins/", now.Unix(), "", []byte(`{"username": "bob", "unix_timestamp": 590729457}`)))
+	rec = httptest.NewRecorder()
+	verifier.ServeHTTP(rec, withoutNonce)
+	assert.Equal(t, http.StatusOK, rec.Code, "A request without a nonce should pass")
+	rec = httptest.NewRecorder()
+	verifier.ServeHTTP(rec, resent(withoutNonce))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "Identical requests without a nonce should be rejected as replays")
+
+	rec = httptest.NewRecorder()
+	verifier.ServeHTTP(rec, signedRequest(t, "shared-secret", now.Add(-10*time.Minute)))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "A stale request should be rejected")
+
+	rec = httptest.NewRecorder()
+	verifier.ServeHTTP(rec, signedRequest(t, "other-secret", now))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "A request signed with another secret should be rejected")
+
+	rec = httptest.NewRecorder()
+	verifier.ServeHTTP(rec, httptest.NewRequest("POST", "/api/identifylogins/", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "An unsigned request should be rejected")
+}
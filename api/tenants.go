@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+
+	ds "github.com/anyaddres/supermann/datastore"
+)
+
+// TenantHeader names the tenant of a request sent with a key that is not bound to one.
+const TenantHeader = "X-Tenant-ID"
+
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Detection holds the thresholds that decide whether a login is suspicious.
+type Detection struct {
+	// SpeedThreshold is the speed in miles per hour above which travel is suspicious.
+	SpeedThreshold float64 `json:"speed_threshold"`
+}
+
+var defaultDetection = &Detection{SpeedThreshold: SpeedThreshold}
+
+type tenantKey struct{}
+
+// loadTenantConfigs reads the detection config of each tenant from a JSON object keyed by tenant.
+// Settings a tenant leaves out keep their defaults.
+func loadTenantConfigs(path string) (map[string]*Detection, error) {
+	tenants := make(map[string]*Detection)
+	if path == "" {
+		return tenants, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parsing tenant config %s: %v", path, err)
+	}
+	for tenant, cfg := range raw {
+		detection := *defaultDetection
+		if err = json.Unmarshal(cfg, &detection); err != nil {
+			return nil, fmt.Errorf("parsing tenant config %s for %s: %v", path, tenant, err)
+		}
+		tenants[tenant] = &detection
+	}
+	return tenants, nil
+}
+
+// detection returns the detection config of the tenant.
+func (ctx *SrvContext) detection(tenant string) *Detection {
+	if detection, ok := ctx.tenants[tenant]; ok {
+		return detection
+	}
+	return defaultDetection
+}
+
+// tenantFor resolves the tenant of a request. A client whose key is bound to a tenant always acts
+// for that tenant, other clients name it in the X-Tenant-ID header and default to the default tenant.
+func tenantFor(client *Client, r *http.Request) (string, *apiErr) {
+	tenant := r.Header.Get(TenantHeader)
+	if tenant == "" {
+		tenant = client.Tenant
+	}
+	if tenant == "" {
+		return ds.DefaultTenant, nil
+	}
+	if !tenantPattern.MatchString(tenant) {
+		return "", newForbiddenErr("Invalid tenant %q", tenant)
+	}
+	if client.Tenant != "" && tenant != client.Tenant {
+		return "", newForbiddenErr("Client %s may not act for tenant %s", client.ID, tenant)
+	}
+	return tenant, nil
+}
+
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFrom returns the tenant a request acts for.
+func tenantFrom(r *http.Request) string {
+	if tenant, ok := r.Context().Value(tenantKey{}).(string); ok {
+		return tenant
+	}
+	return ds.DefaultTenant
+}
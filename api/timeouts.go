@@ -0,0 +1,28 @@
+package api
+
+import (
+	"context"
+	"time"
+)
+
+// The stages of serving a request, as named by the timeout errors and metrics.
+const (
+	stageGeoIP      = "geoip"
+	stageNeighbours = "neighbours"
+	stagePersist    = "persist"
+	stageDatastore  = "datastore"
+)
+
+// runStage runs a stage of serving a request within its own timeout, a zero timeout leaving it
+// bounded by the request only. A failure is reported by newStageErr.
+func runStage(ctx context.Context, stage string, timeout time.Duration, run func(ctx context.Context) error) *apiErr {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := run(ctx); err != nil {
+		return newStageErr(ctx, stage, err)
+	}
+	return nil
+}
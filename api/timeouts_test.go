@@ -0,0 +1,61 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	ds "github.com/anyaddres/supermann/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunStage(t *testing.T) {
+	before := stageTimeouts.With(stageNeighbours).Value()
+	err := runStage(context.Background(), stageNeighbours, time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		// The driver reports an interrupted query rather than the context error.
+		return errors.New("interrupted")
+	})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusGatewayTimeout, err.Status, "A stage past its deadline should answer 504")
+		assert.Equal(t, "timeout", err.Code)
+	}
+	assert.Equal(t, before+1, stageTimeouts.With(stageNeighbours).Value())
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = runStage(canceled, stagePersist, 0, func(ctx context.Context) error { return ctx.Err() })
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusServiceUnavailable, err.Status, "A stage whose client went away should answer 503")
+	}
+
+	err = runStage(context.Background(), stageGeoIP, time.Second, func(ctx context.Context) error {
+		return errors.New("broken")
+	})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusInternalServerError, err.Status, "Other failures should answer 500")
+	}
+	assert.Nil(t, runStage(context.Background(), stageGeoIP, time.Second, func(ctx context.Context) error { return nil }))
+}
+
+func TestStageErrForDatastoreKinds(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		kind   error
+		status int
+		code   string
+	}{
+		{ds.ErrNotFound, http.StatusNotFound, "not_found"},
+		{ds.ErrConflict, http.StatusConflict, "conflict"},
+		{ds.ErrBusy, http.StatusServiceUnavailable, "busy"},
+		{ds.ErrCorrupt, http.StatusInternalServerError, "corrupt"},
+	} {
+		err := newStageErr(ctx, stageDatastore, &ds.Error{Op: "test", Kind: tc.kind, Err: errors.New("failed")})
+		assert.Equal(t, tc.status, err.Status, "%v should answer %d", tc.kind, tc.status)
+		assert.Equal(t, tc.code, err.Code)
+	}
+	err := newStageErr(ctx, stageDatastore, ds.ErrBusy)
+	assert.Equal(t, busyRetryAfter, err.retryAfter, "Clients should be told when to retry a busy datastore")
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/anyaddres/supermann/tracing"
+)
+
+// traceHandler starts the server span of each request, continuing the trace of the caller when
+// the request carries a traceparent header.
+type traceHandler struct {
+	next http.Handler
+}
+
+func (h *traceHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	route, method := routeLabels(req)
+	ctx := tracing.Extract(req.Context(), req.Header)
+	ctx, span := tracing.StartAt(ctx, method+" "+route, tracing.KindServer, time.Now())
+	defer span.End()
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("http.route", route)
+	span.SetAttribute("url.path", req.URL.Path)
+	rec := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+	h.next.ServeHTTP(rec, req.WithContext(ctx))
+	span.SetAttribute("http.response.status_code", rec.status)
+	if rec.status >= http.StatusInternalServerError {
+		span.SetError(errStatus(rec.status))
+	}
+}
+
+// errStatus is the error recorded on the spans of requests that failed with a server error.
+type errStatus int
+
+func (e errStatus) Error() string {
+	return strconv.Itoa(int(e)) + " " + http.StatusText(int(e))
+}
@@ -0,0 +1,162 @@
+// Package certs builds the TLS configuration of the server. The certificate, key and client CA
+// bundle are reloaded when their files change, so certificates can be rotated without a restart.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader serves the certificate and client CAs found in its files, checking them for changes
+// at most once per interval.
+type Reloader struct {
+	certFile, keyFile, clientCAFile string
+	clientAuth                      tls.ClientAuthType
+	interval                        time.Duration
+
+	// base is the configuration served with. Each handshake gets a copy of it with the current
+	// certificate and client CAs, so it keeps the protocols and session tickets of base.
+	base *tls.Config
+
+	mutex     sync.RWMutex
+	config    *tls.Config
+	modTimes  []time.Time
+	lastCheck time.Time
+}
+
+// NewReloader loads the certificate and key, and the client CA bundle when one is given. With a
+// client CA bundle, clients have to present a certificate signed by one of the CAs unless
+// optional is set, in which case only certificates that are presented are verified.
+func NewReloader(certFile, keyFile, clientCAFile string, optional bool, interval time.Duration) (*Reloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls needs both a certificate and a key file")
+	}
+	r := &Reloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile,
+		clientAuth: tls.NoClientCert, interval: interval}
+	if clientCAFile != "" {
+		r.clientAuth = tls.RequireAndVerifyClientCert
+		if optional {
+			r.clientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns the configuration to serve with, offering HTTP/2 and HTTP/1.1. Every handshake
+// picks up the current certificate and client CAs.
+func (r *Reloader) TLSConfig() *tls.Config {
+	r.base = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	r.base.GetConfigForClient = r.configForClient
+	return r.base
+}
+
+// configForClient copies the configuration served with, which the http server may have added to,
+// swapping in the current certificate and client CAs. The session ticket keys are not set on the
+// copy, so the ones of the configuration served with are used.
+func (r *Reloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	current := r.current()
+	config := r.base.Clone()
+	config.GetConfigForClient = nil
+	config.Certificates = current.Certificates
+	config.ClientAuth = current.ClientAuth
+	config.ClientCAs = current.ClientCAs
+	return config, nil
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	return files
+}
+
+// current returns the configuration for a handshake, reloading it first if the files changed.
+// A failed reload keeps the previous configuration.
+func (r *Reloader) current() *tls.Config {
+	r.mutex.RLock()
+	config, due := r.config, time.Since(r.lastCheck) > r.interval
+	r.mutex.RUnlock()
+	if !due {
+		return config
+	}
+	r.mutex.Lock()
+	r.lastCheck = time.Now()
+	r.mutex.Unlock()
+	changed, err := r.changed()
+	if err != nil {
+		slog.Error("checking tls files failed", "error", err)
+		return config
+	}
+	if changed {
+		if err = r.load(); err != nil {
+			slog.Error("reloading tls files failed", "error", err)
+			return config
+		}
+		slog.Info("reloaded tls certificate", "file", r.certFile)
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.config
+}
+
+func (r *Reloader) changed() (bool, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for i, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		if !info.ModTime().Equal(r.modTimes[i]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *Reloader) load() error {
+	modTimes := make([]time.Time, 0, 3)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   r.clientAuth,
+	}
+	if r.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.clientCAFile)
+		if err != nil {
+			return err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.clientCAFile)
+		}
+	}
+	r.mutex.Lock()
+	r.config, r.modTimes, r.lastCheck = config, modTimes, time.Now()
+	r.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,192 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// issuer is a certificate with its key, which signs the certificates issued by it.
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// issue returns a certificate with the serial signed by parent, or self signed when parent is nil.
+func issue(t *testing.T, serial int64, ca bool, parent *issuer) *issuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "superman test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{"localhost"},
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &issuer{cert: cert, key: key, der: der}
+}
+
+// write stores the certificate and its key as PEM files, marking them modified at modTime.
+func (i *issuer) write(t *testing.T, certFile, keyFile string, modTime time.Time) {
+	keyDER, err := x509.MarshalECPrivateKey(i.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{certFile: {Type: "CERTIFICATE", Bytes: i.der}}
+	if keyFile != "" {
+		files[keyFile] = &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}
+	}
+	for file, block := range files {
+		if err = os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// tlsClient returns a client certificate for the issuer.
+func (i *issuer) tlsClient() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{i.der}, PrivateKey: i.key}
+}
+
+// handshake connects to a server serving config and returns the state of the connection, or the
+// error of the server or the client.
+func handshake(t *testing.T, config *tls.Config, client *tls.Config) (tls.ConnectionState, error) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	served := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			served <- err
+			return
+		}
+		defer conn.Close()
+		served <- conn.(*tls.Conn).Handshake()
+	}()
+	conn, err := tls.Dial("tcp", listener.Addr().String(), client)
+	if err != nil {
+		<-served
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	if err = <-served; err != nil {
+		return tls.ConnectionState{}, err
+	}
+	return conn.ConnectionState(), nil
+}
+
+func TestReloaderLoadsAndReloads(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ca := issue(t, 1, true, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	issue(t, 2, false, ca).write(t, certFile, keyFile, time.Now().Add(-time.Minute))
+
+	_, err := NewReloader(certFile, "", "", false, 0)
+	assert.NotNil(t, err, "A certificate without a key should be rejected")
+	r, err := NewReloader(certFile, keyFile, "", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := r.TLSConfig()
+	client := &tls.Config{RootCAs: roots, ServerName: "localhost", NextProtos: []string{"h2", "http/1.1"}}
+	state, err := handshake(t, config, client)
+	if assert.Nil(t, err) {
+		assert.Equal(t, int64(2), state.PeerCertificates[0].SerialNumber.Int64())
+		assert.Equal(t, "h2", state.NegotiatedProtocol, "HTTP/2 should be negotiated over ALPN")
+	}
+	state, err = handshake(t, config, &tls.Config{RootCAs: roots, ServerName: "localhost", NextProtos: []string{"http/1.1"}})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "http/1.1", state.NegotiatedProtocol)
+	}
+
+	issue(t, 3, false, ca).write(t, certFile, keyFile, time.Now())
+	state, err = handshake(t, config, client)
+	if assert.Nil(t, err) {
+		assert.Equal(t, int64(3), state.PeerCertificates[0].SerialNumber.Int64(), "A changed certificate should be served")
+	}
+
+	os.WriteFile(keyFile, []byte("broken"), 0600)
+	os.Chtimes(keyFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	state, err = handshake(t, config, client)
+	if assert.Nil(t, err, "A failed reload should keep serving") {
+		assert.Equal(t, int64(3), state.PeerCertificates[0].SerialNumber.Int64())
+	}
+}
+
+func TestReloaderVerifiesClients(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := issue(t, 1, true, nil)
+	ca.write(t, caFile, "", time.Now())
+	issue(t, 2, false, ca).write(t, certFile, keyFile, time.Now())
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	signed := issue(t, 3, false, ca).tlsClient()
+	stranger := issue(t, 4, false, issue(t, 5, true, nil)).tlsClient()
+	client := func(certs ...tls.Certificate) *tls.Config {
+		return &tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: certs}
+	}
+
+	os.WriteFile(filepath.Join(dir, "empty.pem"), []byte("no certificates"), 0600)
+	_, err := NewReloader(certFile, keyFile, filepath.Join(dir, "empty.pem"), false, 0)
+	assert.NotNil(t, err, "A client CA bundle without certificates should be rejected")
+
+	required, err := NewReloader(certFile, keyFile, caFile, false, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = handshake(t, required.TLSConfig(), client(signed))
+	assert.Nil(t, err, "A client signed by the CA should be accepted")
+	_, err = handshake(t, required.TLSConfig(), client())
+	assert.NotNil(t, err, "A client without a certificate should be rejected")
+	_, err = handshake(t, required.TLSConfig(), client(stranger))
+	assert.NotNil(t, err, "A client signed by another CA should be rejected")
+
+	optional, err := NewReloader(certFile, keyFile, caFile, true, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = handshake(t, optional.TLSConfig(), client())
+	assert.Nil(t, err, "A client without a certificate should be accepted when certificates are optional")
+	_, err = handshake(t, optional.TLSConfig(), client(stranger))
+	assert.NotNil(t, err, "A presented certificate should still be verified")
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/anyaddres/supermann/api"
+	"github.com/anyaddres/supermann/config"
+	ds "github.com/anyaddres/supermann/datastore"
+)
+
+// commands are the administrative subcommands of the superman binary. Without a subcommand
+// superman starts the API server.
+var commands = map[string]func(args []string) error{
+	"erase":     erase,
+	"apikey":    apikey,
+	"rebalance": rebalance,
+}
+
+func runCommand(name string, args []string) {
+	cmd, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		log.Fatalf("Unknown command %s, expected one of %v", name, names)
+	}
+	if err := cmd(args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// erase removes all the data stored for a user, for right to erasure requests.
+func erase(args []string) error {
+	flags := flag.NewFlagSet("erase", flag.ExitOnError)
+	username := flags.String("username", "", "the user whose data is erased")
+	tenant := flags.String("tenant", ds.DefaultTenant, "the tenant of the user")
+	flags.Parse(args)
+	if *username == "" {
+		return errors.New("erase: -username is required")
+	}
+	appServer := api.NewServer()
+	defer appServer.ServerCleanup()
+	resp, err := appServer.EraseUser(context.Background(), *tenant, *username, "cli")
+	if err != nil {
+		return err
+	}
+	return printJSON(resp)
+}
+
+// apikey manages the api keys clients authenticate with.
+func apikey(args []string) error {
+	if len(args) == 0 {
+		return errors.New("apikey: expected one of create, list or revoke")
+	}
+	flags := flag.NewFlagSet("apikey "+args[0], flag.ExitOnError)
+	clientID := flags.String("client", "", "the client the key is issued to")
+	tenant := flags.String("tenant", ds.DefaultTenant, "the tenant the key is bound to, "+ds.AnyTenant+" for any tenant")
+	scopes := flags.String("scopes", string(api.ScopeIngest), "comma separated scopes of the key: ingest, read, admin")
+	id := flags.Int64("id", 0, "the id of the key to revoke")
+	flags.Parse(args[1:])
+
+	appServer := api.NewServer()
+	defer appServer.ServerCleanup()
+	switch args[0] {
+	case "create":
+		key, err := appServer.CreateAPIKey(context.Background(), *clientID, *tenant, strings.Split(*scopes, ","), "cli")
+		if err != nil {
+			return err
+		}
+		return printJSON(key)
+	case "list":
+		keys, err := appServer.ListAPIKeys(context.Background())
+		if err != nil {
+			return err
+		}
+		return printJSON(keys)
+	case "revoke":
+		return appServer.RevokeAPIKey(context.Background(), *id, "cli")
+	}
+	return fmt.Errorf("apikey: unknown action %s, expected one of create, list or revoke", args[0])
+}
+
+// rebalance moves the logins between the database files after the list of shards changed. It
+// runs on the files directly, while the server is stopped.
+func rebalance(args []string) error {
+	cfg := config.GetConfig()
+	flags := flag.NewFlagSet("rebalance", flag.ExitOnError)
+	shards := flags.String("shards", cfg.DatabaseShards, "comma separated database files the logins are spread over")
+	drain := flags.String("drain", "", "comma separated database files no longer used, whose logins are moved out")
+	flags.Parse(args)
+	var drained []string
+	if *drain != "" {
+		drained = ds.ParseShards(*drain, "")
+	}
+	report, err := ds.Rebalance(context.Background(), ds.ParseShards(*shards, cfg.DatabaseFile), drained,
+		len(cfg.PseudonymKeys) > 0)
+	if err != nil {
+		return err
+	}
+	return printJSON(report)
+}
+
+func printJSON(v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stdout, string(out))
+	return nil
+}
@@ -1,29 +1,132 @@
 package main // import "github.com/anyaddres/supermann/modules"
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"time"
 
 	"github.com/anyaddres/supermann/api"
-)
-
-const (
-	// Port ...
-	Port = ":8080"
+	"github.com/anyaddres/supermann/certs"
+	"github.com/anyaddres/supermann/config"
+	"github.com/anyaddres/supermann/logging"
+	"github.com/anyaddres/supermann/metrics"
+	"github.com/anyaddres/supermann/tracing"
 )
 
 func main() {
-	log.Println("Starting logins identification server...")
-	log.Printf("Go version %s", runtime.Version())
+	cfg := config.GetConfig()
+	if err := logging.Setup(os.Stderr, cfg.LogLevel, cfg.LogRedact); err != nil {
+		log.Fatal(err)
+	}
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+	slog.Info("Starting logins identification server", "go_version", runtime.Version())
+	if err := setupTracing(cfg); err != nil {
+		log.Fatal(err)
+	}
 	mux := http.NewServeMux()
 
 	appServer := api.NewServer()
 	appServer.DbPing()
-	defer appServer.ServerCleanup()
-	mux.Handle("/api/identifylogins/", appServer)
-	err := http.ListenAndServe(Port, mux)
-	if err != nil {
+	if err := appServer.StartRetention(); err != nil {
+		log.Fatal(err)
+	}
+	handler := appServer.Handler()
+	mux.Handle("/api/identifylogins/", handler)
+	mux.Handle("/api/events/", handler)
+	mux.Handle("/api/admin/", handler)
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", appServer.Healthz)
+	mux.HandleFunc("/readyz", appServer.Readyz)
+	srv := &http.Server{Addr: cfg.ListenAddr, Handler: mux}
+	if cfg.TLSCertFile != "" {
+		reloader, err := certs.NewReloader(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile,
+			cfg.TLSClientCertOptional, cfg.TLSReloadInterval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.TLSConfig = reloader.TLSConfig()
+	}
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go reloadOnHangup(appServer)
+	serveErr := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			slog.Info("Serving TLS", "addr", cfg.ListenAddr)
+			serveErr <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		serveErr <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		appServer.ServerCleanup()
+		tracing.Close()
 		log.Fatal(err)
+	case sig := <-signals:
+		slog.Info("Shutting down", "signal", sig.String(), "timeout", cfg.ShutdownTimeout.String())
+	}
+	shutdown(srv, appServer, cfg.ShutdownTimeout, signals)
+}
+
+// reloadOnHangup reloads the GeoIP database whenever the process receives SIGHUP.
+func reloadOnHangup(appServer *api.Server) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if _, err := appServer.ReloadGeoIP(); err != nil {
+			slog.Error("Reloading the GeoIP database failed", "error", err)
+		}
+	}
+}
+
+// shutdown stops accepting connections and waits up to timeout for the in-flight requests to
+// finish before closing the datastore and GeoIP handles. A second signal exits right away.
+func shutdown(srv *http.Server, appServer *api.Server, timeout time.Duration, signals <-chan os.Signal) {
+	go func() {
+		sig := <-signals
+		slog.Warn("Exiting without draining", "signal", sig.String())
+		os.Exit(1)
+	}()
+	appServer.StartShutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("In-flight requests did not finish in time", logging.KeyError, err)
+	}
+	appServer.ServerCleanup()
+	if err := tracing.Close(); err != nil {
+		slog.Error("closing the span exporter failed", logging.KeyError, err)
+	}
+	slog.Info("Shutdown complete")
+}
+
+// setupTracing starts exporting spans as the configuration asks for.
+func setupTracing(cfg *config.Config) error {
+	switch cfg.TraceExporter {
+	case "":
+		return nil
+	case "stdout":
+		tracing.Setup(os.Stdout, cfg.TraceSampleRatio)
+	case "file":
+		f, err := os.OpenFile(cfg.TraceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		tracing.Setup(f, cfg.TraceSampleRatio)
+	default:
+		return fmt.Errorf("unknown trace exporter %q, expected stdout or file", cfg.TraceExporter)
 	}
+	slog.Info("Exporting spans", "exporter", cfg.TraceExporter, "sample_ratio", cfg.TraceSampleRatio)
+	return nil
 }
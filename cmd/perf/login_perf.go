@@ -8,9 +8,11 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/anyaddres/supermann/api"
+	"github.com/anyaddres/supermann/signing"
 
 	"github.com/icrowley/fake"
 )
@@ -45,6 +47,14 @@ func main() {
 			panic(err)
 		}
 		req.Header.Set("Content-Type", "application/json")
+		if key := os.Getenv("SUPERMAN_API_KEY"); key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		if secret := os.Getenv("SUPERMAN_SIGNING_SECRET"); secret != "" {
+			if err = signing.Sign(req, []byte(secret), time.Now()); err != nil {
+				panic(err)
+			}
+		}
 
 		client := &http.Client{}
 		t1 := time.Now()
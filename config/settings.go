@@ -1,11 +1,115 @@
 package config
 
-import "github.com/joeshaw/envdecode"
+import (
+	"time"
+
+	"github.com/joeshaw/envdecode"
+)
 
 // Config ...
 type Config struct {
+	ListenAddr   string `env:"LISTEN_ADDR,default=:8080"`
 	DatabaseFile string `env:"DATABASE_FILE,default=logins.db"`
 	GeoIPDB      string `env:"GEO_IP_DB,default=/GeoLite2/GeoLite2-City.mmdb"`
+	// DatabaseReadConns is the most connections reads run on in parallel, next to the single
+	// connection writes run on. Zero runs reads on the write connection.
+	DatabaseReadConns int `env:"DATABASE_READ_CONNS,default=4"`
+	// DatabaseBatchWindow is how long a login insert waits for others to be committed with it in one
+	// transaction, up to DatabaseBatchSize inserts. Zero commits each insert on its own.
+	DatabaseBatchWindow time.Duration `env:"DATABASE_BATCH_WINDOW,default=2ms"`
+	DatabaseBatchSize   int           `env:"DATABASE_BATCH_SIZE,default=128"`
+	// DatabaseBusyRetries is how many times a datastore operation finding the database locked is
+	// run again, waiting twice as long before each retry, before the request fails with 503.
+	DatabaseBusyRetries int `env:"DATABASE_BUSY_RETRIES,default=4"`
+	// DatabaseShards lists the database files the logins are spread over by a hash of the username,
+	// separated by commas. When unset DatabaseFile is the only one. The first file also holds the api
+	// keys, and changing the list requires running the rebalance command.
+	DatabaseShards string `env:"DATABASE_SHARDS"`
+	// GeoIPProviders lists the GeoIP databases to ask in order as kind:path, separated by commas.
+	// The kinds are maxmind, ip2location and csv. When unset GeoIPDB is the only database.
+	GeoIPProviders string `env:"GEO_IP_PROVIDERS"`
+	// GeoIPOverrides is a file of CIDR ranges with fixed locations, asked before the databases.
+	GeoIPOverrides string `env:"GEO_IP_OVERRIDES"`
+	// GeoIPLanguages are the languages of the place names in order of preference, separated by commas.
+	GeoIPLanguages string `env:"GEO_IP_LANGUAGES,default=en"`
+	// GeoIPReloadInterval is how often the GeoIP database files are checked for changes, zero disables
+	// the check. The files should be replaced by renaming the new ones over them.
+	GeoIPReloadInterval time.Duration `env:"GEO_IP_RELOAD_INTERVAL,default=1m"`
+	// LocationCacheSize is the most locations cached, the least recently used going first. Zero
+	// disables the cache. Cached locations expire after LocationCacheTTL, zero keeps them until the
+	// GeoIP database is reloaded.
+	LocationCacheSize int           `env:"LOCATION_CACHE_SIZE,default=100000"`
+	LocationCacheTTL  time.Duration `env:"LOCATION_CACHE_TTL,default=24h"`
+	// LocationCacheByNetwork caches a location for the whole network the GeoIP database has it for,
+	// when the database tells the network.
+	LocationCacheByNetwork bool `env:"LOCATION_CACHE_BY_NETWORK,default=false"`
+	// LatestLoginCacheSize is the most users whose latest login is cached, the least recently active
+	// going first. Zero disables the cache.
+	LatestLoginCacheSize int `env:"LATEST_LOGIN_CACHE_SIZE,default=100000"`
+	// LatestLoginCacheTTL is how long a latest login is cached, which bounds how long the server keeps
+	// using a login erased by the erase command. Zero keeps it until it is replaced.
+	LatestLoginCacheTTL time.Duration `env:"LATEST_LOGIN_CACHE_TTL,default=1m"`
+	// AuthEnabled requires every request to carry an api key. When disabled all requests are
+	// attributed to the anonymous client, which holds every scope. It is off by default so that
+	// deployments from before api keys keep working until keys are created.
+	AuthEnabled bool `env:"AUTH_ENABLED,default=false"`
+	// SigningSecret requires every request to be signed with it, see the signing package.
+	SigningSecret string `env:"SIGNING_SECRET"`
+	// SigningWindow is how far the signature timestamp may be off from the server's clock.
+	SigningWindow time.Duration `env:"SIGNING_WINDOW,default=5m"`
+	// TLSCertFile and TLSKeyFile switch the server to TLS. Both files are reloaded when they change.
+	TLSCertFile string `env:"TLS_CERT_FILE"`
+	TLSKeyFile  string `env:"TLS_KEY_FILE"`
+	// TLSClientCAFile requires clients to present a certificate signed by one of its CAs.
+	TLSClientCAFile string `env:"TLS_CLIENT_CA_FILE"`
+	// TLSClientCertOptional only verifies the client certificates that are presented.
+	TLSClientCertOptional bool          `env:"TLS_CLIENT_CERT_OPTIONAL,default=false"`
+	TLSReloadInterval     time.Duration `env:"TLS_RELOAD_INTERVAL,default=1m"`
+	// ShutdownTimeout is how long in-flight requests are given to finish on shutdown.
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT,default=30s"`
+	// MaxBodyBytes is the largest request body accepted.
+	MaxBodyBytes int64 `env:"MAX_BODY_BYTES,default=65536"`
+	// RequestTimeout bounds the time taken to serve a request, zero leaves it unbounded. Within it
+	// GeoIPTimeout bounds the location lookup of a login, NeighbourTimeout the reads of its
+	// neighbouring logins and PersistTimeout storing it. A zero stage timeout leaves the stage bounded
+	// by the request only.
+	RequestTimeout   time.Duration `env:"REQUEST_TIMEOUT,default=10s"`
+	GeoIPTimeout     time.Duration `env:"GEO_IP_TIMEOUT,default=1s"`
+	NeighbourTimeout time.Duration `env:"NEIGHBOUR_TIMEOUT,default=5s"`
+	PersistTimeout   time.Duration `env:"PERSIST_TIMEOUT,default=5s"`
+	// RateLimitClient and RateLimitTenant are the sustained requests per second allowed to each
+	// client and each tenant, with bursts of up to their Burst requests. Zero disables the limit.
+	RateLimitClient      float64 `env:"RATE_LIMIT_CLIENT,default=0"`
+	RateLimitClientBurst int     `env:"RATE_LIMIT_CLIENT_BURST,default=0"`
+	RateLimitTenant      float64 `env:"RATE_LIMIT_TENANT,default=0"`
+	RateLimitTenantBurst int     `env:"RATE_LIMIT_TENANT_BURST,default=0"`
+	// RateLimitIP is the sustained requests per second allowed to each client ip address, checked
+	// before the api key is looked up, with bursts of up to RateLimitIPBurst. Zero disables the limit.
+	RateLimitIP      float64 `env:"RATE_LIMIT_IP,default=0"`
+	RateLimitIPBurst int     `env:"RATE_LIMIT_IP_BURST,default=0"`
+	// TenantConfigFile is a JSON object holding the detection config of each tenant by tenant id.
+	TenantConfigFile string `env:"TENANT_CONFIG_FILE"`
+	// RetentionDays is how long logins are kept, by event time. Zero keeps them forever.
+	RetentionDays int `env:"RETENTION_DAYS,default=0"`
+	// RetentionMinEvents is the number of most recent logins kept per user regardless of their age.
+	RetentionMinEvents int           `env:"RETENTION_MIN_EVENTS,default=0"`
+	RetentionBatchSize int           `env:"RETENTION_BATCH_SIZE,default=500"`
+	RetentionInterval  time.Duration `env:"RETENTION_INTERVAL,default=1h"`
+	// PseudonymKeys enables pseudonymised storage of usernames and ip addresses. Keys have the
+	// id:secret form and are separated by semicolons, the key used for new logins first.
+	PseudonymKeys []string `env:"PSEUDONYM_KEYS"`
+	// PseudonymIPMode is either truncate or encrypt.
+	PseudonymIPMode string `env:"PSEUDONYM_IP_MODE,default=truncate"`
+	// LogLevel is one of debug, info, warn or error. It can be changed while running.
+	LogLevel string `env:"LOG_LEVEL,default=info"`
+	// LogRedact replaces usernames and ip addresses in the logs.
+	LogRedact bool `env:"LOG_REDACT,default=false"`
+	// TraceExporter writes spans to stdout or to TraceFile when set to stdout or file.
+	TraceExporter string `env:"TRACE_EXPORTER"`
+	TraceFile     string `env:"TRACE_FILE,default=spans.jsonl"`
+	// TraceSampleRatio is the share of the traces started by the server that are recorded. Traces
+	// continued from a caller follow the caller's sampling decision.
+	TraceSampleRatio float64 `env:"TRACE_SAMPLE_RATIO,default=1"`
 }
 
 // GetConfig ...
@@ -0,0 +1,119 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+const apiKeyColumns = "id,client_id,tenant,key_hash,scopes,created_unix,revoked_unix"
+
+// InsertAPIKey stores a new api key and returns its id.
+func (db *DB) InsertAPIKey(ctx context.Context, key *APIKeyDAO) (int64, error) {
+	defer observe(ctx, "insert_api_key", time.Now())
+	if key.CreatedUnix == 0 {
+		key.CreatedUnix = time.Now().Unix()
+	}
+	err := db.retry(ctx, "insert_api_key", func() error {
+		res, err := db.primary().dbh.ExecContext(ctx, "INSERT INTO api_keys (client_id, tenant, key_hash, scopes, created_unix, revoked_unix) "+
+			"VALUES (?,?,?,?,?,0)", key.ClientID, key.Tenant, key.KeyHash, strings.Join(key.Scopes, ","), key.CreatedUnix)
+		if err != nil {
+			return err
+		}
+		key.ID, err = res.LastInsertId()
+		return err
+	})
+	return key.ID, err
+}
+
+// GetAPIKeyByHash returns the api key with the given hash, revoked or not. It returns
+// ErrNotFound when no such key exists.
+func (db *DB) GetAPIKeyByHash(ctx context.Context, keyHash string) (key *APIKeyDAO, err error) {
+	defer observe(ctx, "get_api_key_by_hash", time.Now())
+	err = db.retry(ctx, "get_api_key_by_hash", func() error {
+		rows, err := db.primary().reader().QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash=?", keyHash)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		if !rows.Next() {
+			if err = rows.Err(); err != nil {
+				return err
+			}
+			return ErrNotFound
+		}
+		key, err = scanAPIKey(rows)
+		return err
+	})
+	return key, err
+}
+
+// GetActiveAPIKeysForClient returns the api keys issued to the client that are not revoked.
+func (db *DB) GetActiveAPIKeysForClient(ctx context.Context, clientID string) (keys []APIKeyDAO, err error) {
+	defer observe(ctx, "get_active_api_keys", time.Now())
+	err = db.retry(ctx, "get_active_api_keys", func() error {
+		rows, err := db.primary().reader().QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE client_id=? AND revoked_unix=0 "+
+			"ORDER BY id", clientID)
+		if err != nil {
+			return err
+		}
+		keys, err = scanAPIKeys(rows)
+		return err
+	})
+	return keys, err
+}
+
+// ListAPIKeys returns all the api keys, revoked ones included.
+func (db *DB) ListAPIKeys(ctx context.Context) (keys []APIKeyDAO, err error) {
+	defer observe(ctx, "list_api_keys", time.Now())
+	err = db.retry(ctx, "list_api_keys", func() error {
+		rows, err := db.primary().reader().QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY id")
+		if err != nil {
+			return err
+		}
+		keys, err = scanAPIKeys(rows)
+		return err
+	})
+	return keys, err
+}
+
+func scanAPIKeys(rows *sql.Rows) ([]APIKeyDAO, error) {
+	defer rows.Close()
+	keys := make([]APIKeyDAO, 0)
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey marks the api key with the given id as revoked. It returns false when there is no
+// such key or it was already revoked.
+func (db *DB) RevokeAPIKey(ctx context.Context, id int64) (revoked bool, err error) {
+	defer observe(ctx, "revoke_api_key", time.Now())
+	err = db.retry(ctx, "revoke_api_key", func() error {
+		res, err := db.primary().dbh.ExecContext(ctx, "UPDATE api_keys SET revoked_unix=? WHERE id=? AND revoked_unix=0", time.Now().Unix(), id)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		revoked = n > 0
+		return err
+	})
+	return revoked, err
+}
+
+func scanAPIKey(rows *sql.Rows) (*APIKeyDAO, error) {
+	key := &APIKeyDAO{}
+	var scopes string
+	err := rows.Scan(&key.ID, &key.ClientID, &key.Tenant, &key.KeyHash, &scopes, &key.CreatedUnix, &key.RevokedUnix)
+	if err != nil {
+		return nil, err
+	}
+	key.Scopes = strings.Split(scopes, ",")
+	return key, nil
+}
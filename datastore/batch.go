@@ -0,0 +1,182 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/anyaddres/supermann/metrics"
+)
+
+var (
+	batchSize = metrics.NewHistogramVec("superman_datastore_batch_size",
+		"Inserts committed together in one transaction.", []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512})
+	batchFailures = metrics.NewCounterVec("superman_datastore_batch_failures_total",
+		"Batches of inserts whose transaction failed, failing every insert in them.")
+)
+
+// errClosed is returned by writes submitted after the DB was closed.
+var errClosed = errors.New("datastore: closed")
+
+// writeOp is a write run within the transaction of a batch. done receives its result once the
+// transaction is committed. ctx is the context of the request submitting it, which only decides
+// whether it runs: its statements must not be interrupted by it, as that rolls back the whole batch.
+type writeOp struct {
+	ctx   context.Context
+	apply func(tx *sql.Tx) error
+	done  chan error
+}
+
+// batcher groups the writes submitted within a window into one transaction, committing them with
+// a single sync of the write ahead log. Each write runs within a savepoint, so that a failing one
+// is rolled back alone.
+type batcher struct {
+	dbh    *sql.DB
+	window time.Duration
+	size   int
+
+	// mutex keeps writes from being submitted while the batcher closes.
+	mutex  sync.RWMutex
+	closed bool
+	ops    chan *writeOp
+	done   chan struct{}
+}
+
+func newBatcher(dbh *sql.DB, window time.Duration, size int) *batcher {
+	b := &batcher{dbh: dbh, window: window, size: max(size, 1), ops: make(chan *writeOp), done: make(chan struct{})}
+	go b.run()
+	return b
+}
+
+// submit queues the write and waits for the transaction it ends up in to be committed. It stops
+// waiting when ctx is done. A write given up on before its turn in the batch is skipped, one given up
+// on after it may still be committed.
+func (b *batcher) submit(ctx context.Context, apply func(tx *sql.Tx) error) error {
+	op := &writeOp{ctx: ctx, apply: apply, done: make(chan error, 1)}
+	b.mutex.RLock()
+	if b.closed {
+		b.mutex.RUnlock()
+		return errClosed
+	}
+	select {
+	case b.ops <- op:
+	case <-ctx.Done():
+		b.mutex.RUnlock()
+		return ctx.Err()
+	}
+	b.mutex.RUnlock()
+	select {
+	case err := <-op.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close commits the writes already submitted and stops the batcher.
+func (b *batcher) close() {
+	b.mutex.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.ops)
+	}
+	b.mutex.Unlock()
+	<-b.done
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+	for op := range b.ops {
+		batch := []*writeOp{op}
+		timer := time.NewTimer(b.window)
+	collect:
+		for len(batch) < b.size {
+			select {
+			case op, ok := <-b.ops:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, op)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		b.commit(batch)
+	}
+}
+
+// commit runs the batch in one transaction and hands each write its result.
+func (b *batcher) commit(batch []*writeOp) {
+	defer observe(context.Background(), "commit_batch", time.Now())
+	batchSize.With().Observe(float64(len(batch)))
+	results, err := transactBatch(b.dbh, batch)
+	if err != nil {
+		batchFailures.With().Inc()
+	}
+	for i, op := range batch {
+		if err != nil {
+			op.done <- err
+		} else {
+			op.done <- results[i]
+		}
+	}
+}
+
+// transactBatch returns the result of each write, or the error that failed the whole transaction.
+func transactBatch(dbh *sql.DB, batch []*writeOp) ([]error, error) {
+	tx, err := dbh.Begin()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]error, len(batch))
+	for i, op := range batch {
+		// The request of the write is gone, there is no one left to store it for.
+		if results[i] = op.ctx.Err(); results[i] != nil {
+			continue
+		}
+		if _, err = tx.Exec("SAVEPOINT write"); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if results[i] = op.apply(tx); results[i] != nil {
+			if _, err = tx.Exec("ROLLBACK TO write"); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+		if _, err = tx.Exec("RELEASE write"); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// write runs apply in a transaction, batched with concurrent writes when batching is enabled. A
+// write whose context is done before its turn in the batch is skipped. apply must run its statements
+// with a context that is not canceled with ctx, such as context.WithoutCancel(ctx): the driver
+// interrupts a statement whose context is done, which rolls back the writes of other requests
+// sharing the transaction.
+func (s *shard) write(ctx context.Context, apply func(tx *sql.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.batch != nil {
+		return s.batch.submit(ctx, apply)
+	}
+	tx, err := s.dbh.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = apply(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
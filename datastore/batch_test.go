@@ -0,0 +1,174 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchedInserts(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db, err := open([]string{"batch.db"}, Options{ReadConns: 4, BatchWindow: 20 * time.Millisecond, BatchSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tdb := db.ForTenant(DefaultTenant)
+
+	var mutex sync.Mutex
+	transactions := make(map[*sql.Tx]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db.primary().write(context.Background(), func(tx *sql.Tx) error {
+				mutex.Lock()
+				defer mutex.Unlock()
+				transactions[tx] = true
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	assert.True(t, len(transactions) < 50, "Concurrent writes should share transactions, %d for 50", len(transactions))
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lg := &LoginEntryDAO{LoginRequestDAO: LoginRequestDAO{UserName: "bob", UnixTimeStamp: int64(1000 + i),
+				EventUUID: fmt.Sprintf("85ad929a-db03-4bf4-9541-8f728fa12e%02d", i), IpAddress: "10.0.0.1"}}
+			if err := tdb.InsertLogin(context.Background(), lg); err != nil {
+				t.Error(err)
+				return
+			}
+			// The insert is committed once acknowledged, so the read pool sees it.
+			stored, err := tdb.GetLoginByUUID(context.Background(), lg.EventUUID)
+			if err != nil || stored == nil {
+				t.Errorf("login %s not read back: %v", lg.EventUUID, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	logins, err := tdb.GetLoginsForUserGreaterThanOrLessThan(context.Background(), "bob", ">", 0)
+	assert.Nil(t, err)
+	assert.Len(t, *logins, 50)
+
+	assert.Nil(t, db.CloseHandle())
+	err = tdb.InsertLogin(context.Background(), &LoginEntryDAO{})
+	assert.True(t, errors.Is(err, errClosed), "Inserts after closing should fail")
+}
+
+func TestBatchFailingWriteRolledBackAlone(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db, err := open([]string{"batch.db"}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseHandle()
+	insert := func(uuid string) *writeOp {
+		return &writeOp{ctx: context.Background(), apply: func(tx *sql.Tx) error {
+			_, err := tx.Exec("INSERT INTO logins (tenant, username, event_uuid) VALUES ('t', 'bob', ?)", uuid)
+			return err
+		}}
+	}
+	failing := &writeOp{ctx: context.Background(), apply: func(tx *sql.Tx) error {
+		if _, err := tx.Exec("INSERT INTO logins (tenant, username, event_uuid) VALUES ('t', 'bob', 'lost')"); err != nil {
+			return err
+		}
+		return errors.New("invalid login")
+	}}
+	results, err := transactBatch(db.primary().dbh, []*writeOp{insert("first"), failing, insert("second")})
+	assert.Nil(t, err)
+	assert.Equal(t, []error{nil, errors.New("invalid login"), nil}, results)
+	var uuids []string
+	rows, err := db.primary().dbh.Query("SELECT event_uuid FROM logins ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uuid string
+		rows.Scan(&uuid)
+		uuids = append(uuids, uuid)
+	}
+	assert.Equal(t, []string{"first", "second"}, uuids, "Only the failing write should be rolled back")
+}
+
+// storedUUIDs returns the event uuids of the logins stored in the shard, in insertion order.
+func storedUUIDs(t *testing.T, s *shard) []string {
+	rows, err := s.dbh.Query("SELECT event_uuid FROM logins ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var uuids []string
+	for rows.Next() {
+		var uuid string
+		rows.Scan(&uuid)
+		uuids = append(uuids, uuid)
+	}
+	return uuids
+}
+
+func TestBatchSkipsWritesOfCanceledRequests(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db, err := open([]string{"batch.db"}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseHandle()
+	insert := func(uuid string) func(tx *sql.Tx) error {
+		return func(tx *sql.Tx) error {
+			_, err := tx.Exec("INSERT INTO logins (tenant, username, event_uuid) VALUES ('t', 'bob', ?)", uuid)
+			return err
+		}
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err := transactBatch(db.primary().dbh, []*writeOp{{ctx: context.Background(), apply: insert("first")},
+		{ctx: canceled, apply: insert("canceled")}, {ctx: context.Background(), apply: insert("second")}})
+	assert.Nil(t, err)
+	assert.Equal(t, []error{nil, context.Canceled, nil}, results)
+
+	b := newBatcher(db.primary().dbh, 200*time.Millisecond, 10)
+	defer b.close()
+	kept := make(chan error, 1)
+	go func() { kept <- b.submit(context.Background(), insert("kept")) }()
+	timeout, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = b.submit(timeout, insert("timed out"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < 150*time.Millisecond, "A write should stop waiting for its batch with its context")
+	assert.Nil(t, <-kept, "The other writes of the batch should be committed")
+	assert.Equal(t, []string{"first", "second", "kept"}, storedUUIDs(t, db.primary()),
+		"Only the writes of canceled requests should be skipped")
+}
+
+func TestWritesAndReadsStopWithContext(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db, err := open([]string{"batch.db"}, Options{ReadConns: 2, BatchWindow: time.Millisecond, BatchSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseHandle()
+	tdb := db.ForTenant(DefaultTenant)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	lg := &LoginEntryDAO{LoginRequestDAO: LoginRequestDAO{UserName: "bob", UnixTimeStamp: 1000,
+		EventUUID: "85ad929a-db03-4bf4-9541-8f728fa12e42", IpAddress: "10.0.0.1"}}
+	assert.Equal(t, context.Canceled, tdb.InsertLogin(ctx, lg), "A canceled insert should not be stored")
+	_, err = tdb.GetLoginsForUserGreaterThanOrLessThan(ctx, "bob", ">", 0)
+	assert.NotNil(t, err, "A canceled read should fail rather than stop the process")
+
+	logins, err := tdb.GetLoginsForUserGreaterThanOrLessThan(context.Background(), "bob", ">", 0)
+	assert.Nil(t, err)
+	assert.Empty(t, *logins)
+}
@@ -2,6 +2,7 @@ package datastore
 
 // LoginEntryDAO represents the data that finally gets persisted into the DB
 type LoginEntryDAO struct {
+	ID int64 `db:"id" json:"-"`
 	LoginRequestDAO
 	LoginInfoDAO
 }
@@ -20,4 +21,46 @@ type LoginInfoDAO struct {
 	Lon    float64 `db:"lon" json:"lon,string"`
 	Radius uint16  `db:"radius" json:"radius,string" `
 	Speed  float64 `db:"speed" json:"speed,string"`
+	PlaceDAO
+}
+
+// PlaceDAO represents where the login came from, as named by the GeoIP database at the time.
+type PlaceDAO struct {
+	Country         string `db:"country" json:"country"`
+	CountryName     string `db:"country_name" json:"country_name"`
+	Subdivision     string `db:"subdivision" json:"subdivision"`
+	SubdivisionName string `db:"subdivision_name" json:"subdivision_name"`
+	City            string `db:"city" json:"city"`
+	PostalCode      string `db:"postal_code" json:"postal_code"`
+	TimeZone        string `db:"time_zone" json:"time_zone"`
+}
+
+// AuditDAO represents a record in the audit log.
+type AuditDAO struct {
+	ID            int64  `db:"id" json:"id"`
+	UnixTimeStamp int64  `db:"unix_timestamp" json:"unix_timestamp"`
+	Action        string `db:"action" json:"action"`
+	Actor         string `db:"actor" json:"actor"`
+	Subject       string `db:"subject" json:"subject"`
+	Detail        string `db:"detail" json:"detail"`
+}
+
+// ErasureDAO reports what was removed when erasing the data of a user.
+type ErasureDAO struct {
+	// Subject is the form in which the audit record refers to the user.
+	Subject     string
+	Logins      int64
+	IpAddresses []string
+	AuditID     int64
+}
+
+// APIKeyDAO represents an api key issued to a client. Only the hash of the key is stored.
+type APIKeyDAO struct {
+	ID          int64    `db:"id" json:"id"`
+	ClientID    string   `db:"client_id" json:"client_id"`
+	Tenant      string   `db:"tenant" json:"tenant,omitempty"`
+	KeyHash     string   `db:"key_hash" json:"-"`
+	Scopes      []string `db:"scopes" json:"scopes"`
+	CreatedUnix int64    `db:"created_unix" json:"created_unix"`
+	RevokedUnix int64    `db:"revoked_unix" json:"revoked_unix,omitempty"`
 }
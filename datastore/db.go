@@ -2,14 +2,43 @@ package datastore
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
-	"strconv"
+	"strings"
+	"time"
 )
 
+// columns lists the logins columns in the order scanLogin expects them.
+const columns = "id,username,unix_timestamp,event_uuid,ip_address,lat,lon,radius,speed," +
+	"country,country_name,subdivision,subdivision_name,city,postal_code,time_zone"
+
 // DB ...
 type DB struct {
-	dbh  *sql.DB
-	name string
+	// shards hold the logins, each user's in the shard owning their slot on the ring. The first
+	// one also holds the api keys and the audit log.
+	shards []*shard
+	ring   *ring
+	pseudo *Pseudonymizer
+	// auditKey keys the hashes by which the audit log refers to erased users, read from the first
+	// shard.
+	auditKey []byte
+	// busyRetries is how many times an operation finding the database busy is run again.
+	busyRetries int
+}
+
+// Options tune how the database is accessed.
+type Options struct {
+	// ReadConns is the most connections reads run on in parallel, next to the single connection
+	// writes run on. Zero runs reads on the write connection.
+	ReadConns int
+	// BatchWindow is how long an insert waits for others to be committed with it in one
+	// transaction, and BatchSize the most inserts committed together. A zero window commits each
+	// insert on its own.
+	BatchWindow time.Duration
+	BatchSize   int
+	// BusyRetries is how many times an operation finding the database locked by another connection
+	// is run again before failing with ErrBusy.
+	BusyRetries int
 }
 
 // Db ...
@@ -22,83 +51,168 @@ const (
 	Synchronous = "PRAGMA synchronous=NORMAL;"
 )
 
-func setupDB(db *sql.DB) {
-	_, err := db.Exec(JournalMode)
-	if err != nil {
-		log.Fatal(err)
+// setupDB sets up the connection and creates and migrates the logins table.
+func setupDB(db *sql.DB) error {
+	if _, err := db.Exec(JournalMode); err != nil {
+		return err
 	}
-	_, err = db.Exec(Synchronous)
-	if err != nil {
-		log.Fatal(err)
+	if _, err := db.Exec(Synchronous); err != nil {
+		return err
 	}
 
 	createStmt := "CREATE TABLE IF NOT EXISTS logins (id INTEGER PRIMARY KEY, username TEXT, " +
 		"unix_timestamp BIGINT, event_uuid TEXT, ip_address TEXT, lat REAL, lon REAL, " +
 		"radius INTEGER, speed REAL);"
-	statement, _ := db.Prepare(createStmt)
-	_, err = statement.Exec()
-	if err != nil {
-		log.Fatal(err)
+	if _, err := db.Exec(createStmt); err != nil {
+		return err
 	}
+	return migrate(db)
 }
 
-// NewDB ...
-func NewDB(dbName string) *DB {
+// NewDB opens the database files, one for each shard. A single file holds all the logins.
+func NewDB(dbNames []string, opts Options) *DB {
 	if db != nil {
 		return db
 	}
-	database, err := sql.Open("sqlite3", "./"+dbName)
+	opened, err := open(dbNames, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
-	setupDB(database)
-	database.SetMaxOpenConns(1)
-	db = &DB{dbh: database, name: dbName}
+	db = opened
 	return db
 }
 
-// CloseHandle ...
-func (db *DB) CloseHandle() {
-	db.dbh.Close()
+// open opens and migrates the database files.
+func open(dbNames []string, opts Options) (*DB, error) {
+	r, err := newRing(dbNames)
+	if err != nil {
+		return nil, err
+	}
+	opened := &DB{ring: r, busyRetries: opts.BusyRetries}
+	for i, name := range dbNames {
+		s, err := openShard(i, name, opts)
+		if err != nil {
+			opened.CloseHandle()
+			return nil, fmt.Errorf("opening shard %s: %w", name, err)
+		}
+		opened.shards = append(opened.shards, s)
+	}
+	if err = opened.primary().dbh.QueryRow("SELECT secret FROM audit_key WHERE id=1").Scan(&opened.auditKey); err != nil {
+		opened.CloseHandle()
+		return nil, classify("audit_key", err)
+	}
+	return opened, nil
+}
+
+// openShard opens the database file, migrating it, with a connection for writes and a pool of
+// connections for reads. The driver sets the journal mode of every connection it opens, so the
+// connections ask for the write ahead log, which lets the reads proceed alongside the writes.
+func openShard(index int, dbName string, opts Options) (*shard, error) {
+	database, err := sql.Open("sqlite3", "./"+dbName+"?_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	if err = setupDB(database); err != nil {
+		database.Close()
+		return nil, classify("setup", err)
+	}
+	database.SetMaxOpenConns(1)
+	opened := &shard{index: index, name: dbName, dbh: database}
+	if opts.ReadConns > 0 {
+		if opened.rdb, err = sql.Open("sqlite3", "./"+dbName+"?_journal_mode=WAL&_query_only=true"); err != nil {
+			database.Close()
+			return nil, err
+		}
+		opened.rdb.SetMaxOpenConns(opts.ReadConns)
+		opened.rdb.SetMaxIdleConns(opts.ReadConns)
+	}
+	if opts.BatchWindow > 0 {
+		opened.batch = newBatcher(database, opts.BatchWindow, opts.BatchSize)
+	}
+	return opened, nil
+}
+
+// CloseHandle commits the pending writes, checkpoints the write ahead logs into the database files
+// and closes the DB, so that the next start has no log to recover.
+func (db *DB) CloseHandle() error {
+	var first error
+	for _, s := range db.shards {
+		if err := s.close(); err != nil && first == nil {
+			first = fmt.Errorf("closing shard %s: %w", s.name, err)
+		}
+	}
+	return first
 }
 
-// GetDBName returns the name of the DB
+// GetDBName returns the names of the database files, separated by commas.
 func (db *DB) GetDBName() string {
-	return db.name
+	names := make([]string, len(db.shards))
+	for i, s := range db.shards {
+		names[i] = s.name
+	}
+	return strings.Join(names, ",")
 }
 
-// InsertLogin ...
-func (db *DB) InsertLogin(lg *LoginEntryDAO) error {
-	InsStmt := "INSERT INTO  LOGINS(username, unix_timestamp, event_uuid, ip_address, lat,lon,radius,speed)" +
-		"VALUES($1,$2,$3,$4,$5,$6,$7,$8)"
-	_, err := db.dbh.Exec(InsStmt, lg.UserName, lg.UnixTimeStamp, lg.EventUUID, lg.IpAddress,
-		lg.Lat, lg.Lon, lg.Radius, lg.Speed)
-	if err != nil {
-		return err
+// UsePseudonymizer makes the DB store pseudonyms of usernames and ip addresses instead of the
+// raw values. Lookups by username keep working as the incoming username is pseudonymised too.
+func (db *DB) UsePseudonymizer(p *Pseudonymizer) {
+	db.pseudo = p
+}
+
+// users returns the forms a username may be stored in, one for each pseudonym key.
+func (db *DB) users(username string) []string {
+	if db.pseudo == nil {
+		return []string{username}
 	}
-	return nil
+	return db.pseudo.UserCandidates(username)
 }
 
-// GetLoginsForUserGreaterThanOrLessThan ...
-func (db *DB) GetLoginsForUserGreaterThanOrLessThan(username, operator string, ts int64) (*[]LoginEntryDAO, error) {
-	log.Println("Inside GetLoginsForUserGreaterThanOrLessThan")
-	columns := "username,unix_timestamp,event_uuid,ip_address,lat,lon,radius,speed"
-	selectStmt := "SELECT " + columns + " from LOGINS where username=? AND unix_timestamp " +
-		operator + " ?;"
-	rows, err := db.dbh.Query(selectStmt, username, strconv.FormatInt(ts, 10))
-	defer rows.Close()
-	if err != nil {
-		log.Fatal(err)
+// StoredUsers returns the forms a username may be stored in, the one new logins are stored under
+// first.
+func (db *DB) StoredUsers(username string) []string {
+	return db.users(username)
+}
+
+// revealIP returns the ip address behind the stored one, as far as the pseudonymisation allows.
+func (db *DB) revealIP(stored string) string {
+	if db.pseudo == nil {
+		return stored
 	}
-	results := make([]LoginEntryDAO, 0)
-	for rows.Next() {
-		lg := LoginEntryDAO{}
-		err = rows.Scan(&lg.UserName, &lg.UnixTimeStamp, &lg.EventUUID, &lg.IpAddress, &lg.Lat,
-			&lg.Lon, &lg.Radius, &lg.Speed)
-		if err != nil {
-			return nil, err
-		}
-		results = append(results, lg)
+	return db.pseudo.RevealIP(stored)
+}
+
+// VisibleIP returns an ip address the way the logins storing it give it back, which is truncated
+// when ip addresses are pseudonymised by truncation.
+func (db *DB) VisibleIP(ip string) string {
+	if db.pseudo == nil || db.pseudo.ipMode != IPTruncate {
+		return ip
+	}
+	return TruncateIP(ip)
+}
+
+// placeholders returns n comma separated bind parameters for an IN clause.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+func toArgs(values []string, more ...interface{}) []interface{} {
+	args := make([]interface{}, 0, len(values)+len(more))
+	for _, v := range values {
+		args = append(args, v)
+	}
+	return append(args, more...)
+}
+
+// scanLogin reads a login from the shard, giving it the id that tells the shard back.
+func (db *DB) scanLogin(s *shard, rows *sql.Rows) (*LoginEntryDAO, error) {
+	lg := &LoginEntryDAO{}
+	err := rows.Scan(&lg.ID, &lg.UserName, &lg.UnixTimeStamp, &lg.EventUUID, &lg.IpAddress, &lg.Lat,
+		&lg.Lon, &lg.Radius, &lg.Speed, &lg.Country, &lg.CountryName, &lg.Subdivision, &lg.SubdivisionName,
+		&lg.City, &lg.PostalCode, &lg.TimeZone)
+	if err != nil {
+		return nil, err
 	}
-	return &results, nil
+	lg.ID = loginID(s, lg.ID)
+	lg.IpAddress = db.revealIP(lg.IpAddress)
+	return lg, nil
 }
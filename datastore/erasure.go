@@ -0,0 +1,140 @@
+package datastore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// ActionErasure is the audit log action recorded for a right to erasure request.
+const ActionErasure = "erasure"
+
+// EraseUser deletes every login stored for the user and records the erasure in the audit log,
+// which is kept in the first shard like every other audit record. The audit record refers to the
+// user by a keyed hash of the username only, so it does not keep the data it documents the removal
+// of. The distinct ip addresses the user logged in from are returned so that callers can drop
+// anything they derived from them. When ip addresses are stored truncated these are the truncated
+// networks. When the user's logins are in the first shard the delete and the audit record are
+// written in one transaction. Otherwise the audit record is written once the delete is committed,
+// and should that fail the erasure is returned along with the error.
+func (t *TenantDB) EraseUser(ctx context.Context, username, actor string) (erasure *ErasureDAO, err error) {
+	defer observe(ctx, "erase_user", time.Now())
+	if err = t.db.retry(ctx, "gather_unplaced", func() error { return t.gatherUnplaced(ctx, username) }); err != nil {
+		return nil, err
+	}
+	s := t.db.shardFor(t.tenant, username)
+	var audit *AuditDAO
+	err = t.db.retry(ctx, "erase_user", func() error {
+		tx, err := s.dbh.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if erasure, audit, err = t.eraseUser(ctx, tx, username, actor); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if s == t.db.primary() {
+			if erasure.AuditID, err = t.insertAudit(ctx, tx, audit); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s != t.db.primary() {
+		if erasure.AuditID, err = t.InsertAudit(ctx, audit); err != nil {
+			return erasure, err
+		}
+	}
+	return erasure, nil
+}
+
+// eraseUser deletes the logins of the user and returns the erasure and the audit record of it.
+func (t *TenantDB) eraseUser(ctx context.Context, tx *sql.Tx, username, actor string) (*ErasureDAO, *AuditDAO, error) {
+	users := t.db.users(username)
+	rows, err := tx.QueryContext(ctx, "SELECT DISTINCT ip_address FROM LOGINS WHERE tenant=? AND username IN ("+
+		placeholders(len(users))+")", append([]interface{}{t.tenant}, toArgs(users)...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	erasure := &ErasureDAO{IpAddresses: make([]string, 0)}
+	for rows.Next() {
+		var ip string
+		if err = rows.Scan(&ip); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		erasure.IpAddresses = append(erasure.IpAddresses, t.db.revealIP(ip))
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM LOGINS WHERE tenant=? AND username IN ("+placeholders(len(users))+")",
+		append([]interface{}{t.tenant}, toArgs(users)...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if erasure.Logins, err = res.RowsAffected(); err != nil {
+		return nil, nil, err
+	}
+	detail, err := json.Marshal(map[string]int64{"logins": erasure.Logins})
+	if err != nil {
+		return nil, nil, err
+	}
+	erasure.Subject = t.db.subject(username)
+	audit := &AuditDAO{Action: ActionErasure, Actor: actor, Subject: erasure.Subject, Detail: string(detail)}
+	return erasure, audit, nil
+}
+
+// subject returns the form in which a username is referred to in the audit log. It is the keyed
+// HMAC of the pseudonymizer when usernames are pseudonymised, and otherwise an HMAC under the
+// random key the database was created with, so that it cannot be matched against a list of
+// usernames hashed elsewhere.
+func (db *DB) subject(username string) string {
+	if db.pseudo != nil {
+		return db.pseudo.Subject(username)
+	}
+	mac := hmac.New(sha256.New, db.auditKey)
+	mac.Write([]byte(username))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// InsertAudit records an action in the audit log and returns the id of the record.
+func (t *TenantDB) InsertAudit(ctx context.Context, audit *AuditDAO) (id int64, err error) {
+	defer observe(ctx, "insert_audit", time.Now())
+	err = t.db.retry(ctx, "insert_audit", func() error {
+		tx, err := t.db.primary().dbh.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if id, err = t.insertAudit(ctx, tx, audit); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (t *TenantDB) insertAudit(ctx context.Context, tx *sql.Tx, audit *AuditDAO) (int64, error) {
+	if audit.UnixTimeStamp == 0 {
+		audit.UnixTimeStamp = time.Now().Unix()
+	}
+	res, err := tx.ExecContext(ctx, "INSERT INTO audit_log (tenant, unix_timestamp, action, actor, subject, detail) "+
+		"VALUES (?,?,?,?,?,?)", t.tenant, audit.UnixTimeStamp, audit.Action, audit.Actor, audit.Subject, audit.Detail)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
@@ -0,0 +1,126 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/anyaddres/supermann/metrics"
+	"github.com/mattn/go-sqlite3"
+)
+
+// The kinds of datastore failures. Errors returned by the DB are matched against them with
+// errors.Is.
+var (
+	// ErrNotFound is returned when the login or api key asked for does not exist.
+	ErrNotFound = errors.New("datastore: not found")
+	// ErrConflict is returned when a write breaks a constraint, such as a duplicate api key.
+	ErrConflict = errors.New("datastore: conflict")
+	// ErrBusy is returned when the database stayed locked by another connection through the retries.
+	ErrBusy = errors.New("datastore: busy")
+	// ErrCorrupt is returned when the database file is damaged or not a database.
+	ErrCorrupt = errors.New("datastore: corrupt")
+)
+
+// busyBackoff is the wait before the first retry of an operation that found the database busy,
+// doubled for each retry after.
+const busyBackoff = 10 * time.Millisecond
+
+var (
+	datastoreErrors = metrics.NewCounterVec("superman_datastore_errors_total",
+		"Failed datastore operations by operation and kind, busy, conflict, corrupt or other.", "op", "kind")
+	busyRetries = metrics.NewCounterVec("superman_datastore_busy_retries_total",
+		"Datastore operations run again after finding the database busy.", "op")
+)
+
+// Error is the failure of a datastore operation. It matches its Kind and its cause with errors.Is.
+type Error struct {
+	Op string
+	// Kind is one of ErrNotFound, ErrConflict, ErrBusy and ErrCorrupt, or nil for other failures.
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+// Unwrap returns the kind and the cause of the failure.
+func (e *Error) Unwrap() []error {
+	if e.Kind == nil || e.Kind == e.Err {
+		return []error{e.Err}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// classify wraps the failure of the operation into an Error telling its kind. An operation stopped
+// by its context did not fail, and its context error is returned as is.
+func classify(op string, err error) error {
+	var classified *Error
+	if err == nil || errors.As(err, &classified) || errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return &Error{Op: op, Kind: kindOf(err), Err: err}
+}
+
+func kindOf(err error) error {
+	for _, kind := range []error{ErrNotFound, ErrConflict, ErrBusy, ErrCorrupt} {
+		if errors.Is(err, kind) {
+			return kind
+		}
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code {
+		case sqlite3.ErrBusy, sqlite3.ErrLocked:
+			return ErrBusy
+		case sqlite3.ErrConstraint:
+			return ErrConflict
+		case sqlite3.ErrCorrupt, sqlite3.ErrNotADB:
+			return ErrCorrupt
+		}
+	}
+	return nil
+}
+
+// kindName names the kind of a failure in the metrics.
+func kindName(err error) string {
+	switch {
+	case errors.Is(err, ErrBusy):
+		return "busy"
+	case errors.Is(err, ErrConflict):
+		return "conflict"
+	case errors.Is(err, ErrCorrupt):
+		return "corrupt"
+	}
+	return "other"
+}
+
+// retry runs the operation, running it again while it finds the database busy, waiting twice as
+// long before each retry, up to the configured number of retries or until ctx is done. Its
+// failure is returned classified.
+func (db *DB) retry(ctx context.Context, op string, run func() error) error {
+	backoff := busyBackoff
+	for attempt := 0; ; attempt++ {
+		err := classify(op, run())
+		var failed *Error
+		if !errors.As(err, &failed) || errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if !errors.Is(err, ErrBusy) || attempt >= db.busyRetries {
+			datastoreErrors.With(op, kindName(err)).Inc()
+			return err
+		}
+		busyRetries.With(op).Inc()
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			datastoreErrors.With(op, kindName(err)).Inc()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,80 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorKinds(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db, err := open([]string{"errors.db"}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseHandle()
+	ctx := context.Background()
+
+	_, err = db.InsertAPIKey(ctx, &APIKeyDAO{ClientID: "a", Tenant: DefaultTenant, KeyHash: "hash"})
+	assert.Nil(t, err)
+	_, err = db.InsertAPIKey(ctx, &APIKeyDAO{ClientID: "b", Tenant: DefaultTenant, KeyHash: "hash"})
+	assert.True(t, errors.Is(err, ErrConflict), "A duplicate api key should conflict, got %v", err)
+
+	_, err = db.GetAPIKeyByHash(ctx, "missing")
+	assert.True(t, errors.Is(err, ErrNotFound), "A missing api key should not be found, got %v", err)
+	tdb := db.ForTenant(DefaultTenant)
+	_, err = tdb.GetLoginByUUID(ctx, "85ad929a-db03-4bf4-9541-8f728fa12e40")
+	assert.True(t, errors.Is(err, ErrNotFound), "A missing event should not be found, got %v", err)
+	err = tdb.DeleteLogin(ctx, loginID(db.primary(), 42), 0, 0)
+	assert.True(t, errors.Is(err, ErrNotFound), "Deleting a missing login should not be found, got %v", err)
+
+	assert.Nil(t, classify("op", nil))
+	assert.Equal(t, context.Canceled, classify("op", context.Canceled), "Context errors should be returned as is")
+	err = classify("op", sqlite3.Error{Code: sqlite3.ErrNotADB})
+	assert.True(t, errors.Is(err, ErrCorrupt), "A file that is not a database should be corrupt, got %v", err)
+	var sqliteErr sqlite3.Error
+	assert.True(t, errors.As(err, &sqliteErr), "The driver error should be kept")
+}
+
+func TestRetryBusy(t *testing.T) {
+	db := &DB{busyRetries: 2}
+	ctx := context.Background()
+	attempts := 0
+	err := db.retry(ctx, "test", func() error {
+		attempts++
+		return sqlite3.Error{Code: sqlite3.ErrBusy}
+	})
+	assert.True(t, errors.Is(err, ErrBusy), "A database busy through the retries should fail busy, got %v", err)
+	assert.Equal(t, 3, attempts, "A busy operation should be run again each retry")
+
+	attempts = 0
+	err = db.retry(ctx, "test", func() error {
+		if attempts++; attempts == 1 {
+			return sqlite3.Error{Code: sqlite3.ErrLocked}
+		}
+		return nil
+	})
+	assert.Nil(t, err, "An operation should succeed once the database is no longer busy")
+	assert.Equal(t, 2, attempts)
+
+	attempts = 0
+	err = db.retry(ctx, "test", func() error {
+		attempts++
+		return sqlite3.Error{Code: sqlite3.ErrConstraint}
+	})
+	assert.True(t, errors.Is(err, ErrConflict))
+	assert.Equal(t, 1, attempts, "Only busy operations should be run again")
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	attempts = 0
+	err = db.retry(canceled, "test", func() error {
+		attempts++
+		return sqlite3.Error{Code: sqlite3.ErrBusy}
+	})
+	assert.True(t, errors.Is(err, ErrBusy))
+	assert.Equal(t, 1, attempts, "A canceled operation should not be retried")
+}
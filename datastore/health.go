@@ -0,0 +1,48 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+)
+
+// Ping reads the schema of every shard, which unlike opening them proves the database files can be
+// read.
+func (db *DB) Ping(ctx context.Context) error {
+	for _, s := range db.shards {
+		if err := s.ping(ctx); err != nil {
+			return fmt.Errorf("shard %s: %w", s.name, err)
+		}
+	}
+	return nil
+}
+
+func (s *shard) ping(ctx context.Context) error {
+	var tables int
+	err := s.reader().QueryRowContext(ctx, "SELECT count(*) FROM sqlite_master WHERE type='table'").Scan(&tables)
+	if err != nil {
+		return err
+	}
+	if tables == 0 {
+		return fmt.Errorf("no tables in the database")
+	}
+	return nil
+}
+
+// Migrations returns the schema version of the database and the version this build migrates to.
+// With several shards the version is that of the least migrated one, unless one is newer than
+// this build.
+func (db *DB) Migrations(ctx context.Context) (int, int, error) {
+	lowest, highest := len(migrations), 0
+	for _, s := range db.shards {
+		var version int
+		err := s.reader().QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+		if err != nil {
+			return 0, 0, fmt.Errorf("shard %s: %w", s.name, err)
+		}
+		lowest, highest = min(lowest, version), max(highest, version)
+	}
+	if highest > len(migrations) {
+		return highest, len(migrations), nil
+	}
+	return lowest, len(migrations), nil
+}
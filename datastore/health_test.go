@@ -0,0 +1,69 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3" // Registering the SQL Lite Driver
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPingAndMigrations(t *testing.T) {
+	dbh, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbh.SetMaxOpenConns(1)
+	defer dbh.Close()
+	db := &DB{shards: []*shard{{dbh: dbh}}}
+	if err = setupDB(dbh); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, db.Ping(context.Background()), "A round trip to an open database should succeed")
+	t.Chdir(t.TempDir())
+	os.WriteFile("garbage.db", []byte("this is not a database, nor any other thing sqlite could read"), 0600)
+	garbage, err := sql.Open("sqlite3", "garbage.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer garbage.Close()
+	assert.NotNil(t, (&DB{shards: []*shard{{name: "garbage.db", dbh: garbage}}}).Ping(context.Background()),
+		"A file that is not a database should fail the ping")
+	version, latest, err := db.Migrations(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, len(migrations), latest)
+	assert.Equal(t, latest, version, "Every migration should have been applied")
+
+	dbh.Exec("DELETE FROM schema_migrations WHERE version=?", latest)
+	version, _, _ = db.Migrations(context.Background())
+	assert.Equal(t, latest-1, version, "A missing migration should be reported")
+}
+
+func TestMigrationBindsOldKeysToDefaultTenant(t *testing.T) {
+	dbh, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbh.SetMaxOpenConns(1)
+	defer dbh.Close()
+	if _, err = dbh.Exec("CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY);"); err != nil {
+		t.Fatal(err)
+	}
+	// The schema from before the keys without a tenant were bound to the default one.
+	for v, m := range migrations[:19] {
+		dbh.Exec(m)
+		dbh.Exec("INSERT INTO schema_migrations (version) VALUES (?)", v+1)
+	}
+	if _, err = dbh.Exec("INSERT INTO api_keys (client_id, key_hash) VALUES ('old', 'hash')"); err != nil {
+		t.Fatal(err)
+	}
+	if err = migrate(dbh); err != nil {
+		t.Fatal(err)
+	}
+	var tenant string
+	assert.Nil(t, dbh.QueryRow("SELECT tenant FROM api_keys WHERE client_id='old'").Scan(&tenant))
+	assert.Equal(t, DefaultTenant, tenant, "Keys from before tenants should be bound to the default tenant")
+}
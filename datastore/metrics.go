@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/anyaddres/supermann/logging"
+	"github.com/anyaddres/supermann/metrics"
+	"github.com/anyaddres/supermann/tracing"
+)
+
+var (
+	queryDuration = metrics.NewHistogramVec("superman_datastore_query_duration_seconds",
+		"Time taken by datastore operations.", metrics.DefBuckets, "op")
+	// rowsReturned shows how many rows the neighbouring login scans read, which grows with the
+	// number of logins stored per user.
+	rowsReturned = metrics.NewHistogramVec("superman_datastore_rows_returned",
+		"Rows read by datastore queries.", []float64{0, 1, 10, 50, 100, 500, 1000, 5000, 10000, 50000}, "op")
+	_ = metrics.NewGaugeFunc("superman_datastore_size_bytes",
+		"Size of the database files on disk.", dbSize, "shard", "file")
+	_ = metrics.NewGaugeFunc("superman_datastore_shard_up",
+		"Whether a query on the shard succeeds, checked when scraped.", shardsUp, "shard")
+	_ = metrics.NewGaugeFunc("superman_datastore_shard_slots",
+		"Slots of the user hash owned by the shard.", shardSlots, "shard")
+)
+
+// observe records, traces and logs at debug level the time taken by the operation started at start.
+func observe(ctx context.Context, op string, start time.Time) {
+	queryDuration.With(op).Observe(time.Since(start).Seconds())
+	_, span := tracing.StartAt(ctx, "datastore."+op, tracing.KindInternal, start)
+	span.SetAttribute("db.system", "sqlite")
+	span.SetAttribute("db.operation", op)
+	span.End()
+	slog.DebugContext(ctx, "datastore operation", "op", op, logging.Took(start))
+}
+
+// dbSize returns the size of the database file and of its write ahead log for every shard.
+func dbSize() []metrics.Sample {
+	if db == nil {
+		return nil
+	}
+	var samples []metrics.Sample
+	for _, s := range db.shards {
+		for _, file := range []string{"main", "wal"} {
+			path := s.name
+			if file == "wal" {
+				path += "-wal"
+			}
+			if info, err := os.Stat(path); err == nil {
+				samples = append(samples, metrics.Sample{LabelValues: []string{s.name, file}, Value: float64(info.Size())})
+			}
+		}
+	}
+	return samples
+}
+
+// shardPingTimeout bounds the query run on each shard when the metrics are scraped.
+const shardPingTimeout = time.Second
+
+// shardsUp returns 1 for every shard a query succeeds on and 0 for the others.
+func shardsUp() []metrics.Sample {
+	if db == nil {
+		return nil
+	}
+	samples := make([]metrics.Sample, len(db.shards))
+	for i, s := range db.shards {
+		ctx, cancel := context.WithTimeout(context.Background(), shardPingTimeout)
+		up := 1.0
+		if err := s.ping(ctx); err != nil {
+			up = 0
+		}
+		cancel()
+		samples[i] = metrics.Sample{LabelValues: []string{s.name}, Value: up}
+	}
+	return samples
+}
+
+// shardSlots returns the number of slots each shard owns.
+func shardSlots() []metrics.Sample {
+	if db == nil {
+		return nil
+	}
+	counts := db.ring.slots(len(db.shards))
+	samples := make([]metrics.Sample, len(db.shards))
+	for i, s := range db.shards {
+		samples[i] = metrics.Sample{LabelValues: []string{s.name}, Value: float64(counts[i])}
+	}
+	return samples
+}
@@ -0,0 +1,74 @@
+package datastore
+
+import (
+	"database/sql"
+)
+
+// migrations are applied in order on startup, each one exactly once. New schema changes are
+// appended to the end of the list, a migration that has shipped is never edited.
+var migrations = []string{
+	"CREATE INDEX IF NOT EXISTS logins_event_uuid ON logins (event_uuid);",
+	"CREATE TABLE IF NOT EXISTS audit_log (id INTEGER PRIMARY KEY, unix_timestamp BIGINT, " +
+		"action TEXT, actor TEXT, subject TEXT, detail TEXT);",
+	"CREATE INDEX IF NOT EXISTS logins_username_unix_timestamp ON logins (username, unix_timestamp);",
+	"CREATE INDEX IF NOT EXISTS logins_unix_timestamp ON logins (unix_timestamp);",
+	"CREATE TABLE IF NOT EXISTS api_keys (id INTEGER PRIMARY KEY, client_id TEXT, key_hash TEXT UNIQUE, " +
+		"scopes TEXT, created_unix BIGINT, revoked_unix BIGINT);",
+	"ALTER TABLE logins ADD COLUMN tenant TEXT NOT NULL DEFAULT '" + DefaultTenant + "';",
+	"CREATE INDEX IF NOT EXISTS logins_tenant_username_unix_timestamp ON logins (tenant, username, unix_timestamp);",
+	"CREATE INDEX IF NOT EXISTS logins_tenant_event_uuid ON logins (tenant, event_uuid);",
+	"ALTER TABLE audit_log ADD COLUMN tenant TEXT NOT NULL DEFAULT '" + DefaultTenant + "';",
+	"ALTER TABLE api_keys ADD COLUMN tenant TEXT NOT NULL DEFAULT '';",
+	"ALTER TABLE logins ADD COLUMN country TEXT NOT NULL DEFAULT '';",
+	"ALTER TABLE logins ADD COLUMN country_name TEXT NOT NULL DEFAULT '';",
+	"ALTER TABLE logins ADD COLUMN subdivision TEXT NOT NULL DEFAULT '';",
+	"ALTER TABLE logins ADD COLUMN subdivision_name TEXT NOT NULL DEFAULT '';",
+	"ALTER TABLE logins ADD COLUMN city TEXT NOT NULL DEFAULT '';",
+	"ALTER TABLE logins ADD COLUMN postal_code TEXT NOT NULL DEFAULT '';",
+	"ALTER TABLE logins ADD COLUMN time_zone TEXT NOT NULL DEFAULT '';",
+	"ALTER TABLE logins ADD COLUMN slot INTEGER NOT NULL DEFAULT -1;",
+	"CREATE INDEX IF NOT EXISTS logins_slot ON logins (slot);",
+	// Keys stored without a tenant predate tenants, when they could only act for the default one.
+	"UPDATE api_keys SET tenant='" + DefaultTenant + "' WHERE tenant='';",
+	"CREATE TABLE IF NOT EXISTS audit_key (id INTEGER PRIMARY KEY CHECK (id = 1), secret BLOB NOT NULL);",
+	"INSERT OR IGNORE INTO audit_key (id, secret) VALUES (1, randomblob(32));",
+}
+
+// migrate brings the schema up to date, recording the applied version in schema_migrations.
+func migrate(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY);")
+	if err != nil {
+		return err
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for v := version; v < len(migrations); v++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(migrations[v]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err = tx.Exec("INSERT INTO schema_migrations (version) VALUES (?)", v+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	err := db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
@@ -0,0 +1,159 @@
+package datastore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// IPTruncate stores only the network of an ip address, a /24 for IPv4 and a /48 for IPv6.
+	IPTruncate = "truncate"
+	// IPEncrypt stores ip addresses encrypted with AES-GCM.
+	IPEncrypt = "encrypt"
+
+	encryptedIPPrefix = "enc:"
+)
+
+// PseudonymKey is a secret used to pseudonymise usernames and ip addresses. Its ID is stored
+// along with every value derived from it so that values derived from older keys are recognised.
+type PseudonymKey struct {
+	ID     string
+	secret []byte
+	aead   cipher.AEAD
+}
+
+// Pseudonymizer turns usernames into keyed HMACs and truncates or encrypts ip addresses before
+// they are stored. The first key is used for new values, the others are kept while rows derived
+// from them remain, which allows the keys to be rotated.
+type Pseudonymizer struct {
+	keys   []*PseudonymKey
+	ipMode string
+}
+
+// NewPseudonymizer parses keys in the id:secret form, the current key first.
+func NewPseudonymizer(keys []string, ipMode string) (*Pseudonymizer, error) {
+	if ipMode != IPTruncate && ipMode != IPEncrypt {
+		return nil, fmt.Errorf("unknown ip pseudonymisation mode %q", ipMode)
+	}
+	p := &Pseudonymizer{ipMode: ipMode}
+	for _, k := range keys {
+		parts := strings.SplitN(k, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("pseudonym keys must have the id:secret form")
+		}
+		key := &PseudonymKey{ID: parts[0], secret: []byte(parts[1])}
+		block, err := aes.NewCipher(key.derive("ip-encryption"))
+		if err != nil {
+			return nil, err
+		}
+		if key.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+		p.keys = append(p.keys, key)
+	}
+	if len(p.keys) == 0 {
+		return nil, errors.New("at least one pseudonym key is required")
+	}
+	return p, nil
+}
+
+func (k *PseudonymKey) derive(purpose string) []byte {
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func (k *PseudonymKey) user(username string) string {
+	return k.pseudonym("username", username)
+}
+
+// pseudonym returns the keyed HMAC of the value under the key derived for the purpose, prefixed
+// with the id of the key.
+func (k *PseudonymKey) pseudonym(purpose, value string) string {
+	mac := hmac.New(sha256.New, k.derive(purpose))
+	mac.Write([]byte(value))
+	return k.ID + ":" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// User returns the pseudonym stored for a username under the current key.
+func (p *Pseudonymizer) User(username string) string {
+	return p.keys[0].user(username)
+}
+
+// UserCandidates returns the pseudonyms of a username under every key, the current one first.
+func (p *Pseudonymizer) UserCandidates(username string) []string {
+	candidates := make([]string, len(p.keys))
+	for i, k := range p.keys {
+		candidates[i] = k.user(username)
+	}
+	return candidates
+}
+
+// Subject returns the form in which a username is referred to in the audit log under the current
+// key. It differs from the stored pseudonym, so audit records cannot be joined with the logins.
+func (p *Pseudonymizer) Subject(username string) string {
+	return p.keys[0].pseudonym("audit-subject", username)
+}
+
+// IP returns the form in which an ip address is stored.
+func (p *Pseudonymizer) IP(ip string) (string, error) {
+	if p.ipMode == IPTruncate {
+		return TruncateIP(ip), nil
+	}
+	key := p.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := key.aead.Seal(nonce, nonce, []byte(ip), []byte(key.ID))
+	return encryptedIPPrefix + key.ID + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// RevealIP returns the ip address behind a stored one. Truncated addresses are returned as they
+// are, as are encrypted ones whose key is no longer configured.
+func (p *Pseudonymizer) RevealIP(stored string) string {
+	if !strings.HasPrefix(stored, encryptedIPPrefix) {
+		return stored
+	}
+	parts := strings.SplitN(strings.TrimPrefix(stored, encryptedIPPrefix), ":", 2)
+	if len(parts) != 2 {
+		return stored
+	}
+	for _, k := range p.keys {
+		if k.ID != parts[0] {
+			continue
+		}
+		sealed, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil || len(sealed) < k.aead.NonceSize() {
+			return stored
+		}
+		nonce, ciphertext := sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():]
+		ip, err := k.aead.Open(nil, nonce, ciphertext, []byte(k.ID))
+		if err != nil {
+			return stored
+		}
+		return string(ip)
+	}
+	return stored
+}
+
+// TruncateIP zeroes the host part of an ip address, keeping a /24 of IPv4 and a /48 of IPv6
+// addresses. Values that do not parse are returned unchanged.
+func TruncateIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
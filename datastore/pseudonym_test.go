@@ -0,0 +1,130 @@
+package datastore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPseudonymizerKeyRotation(t *testing.T) {
+	old, err := NewPseudonymizer([]string{"k1:first-secret"}, IPEncrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := NewPseudonymizer([]string{"k2:second-secret", "k1:first-secret"}, IPEncrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, "bob", old.User("bob"), "The username should not be stored as is")
+	assert.Equal(t, old.User("bob"), rotated.UserCandidates("bob")[1], "Pseudonyms of the old key should be looked up")
+	assert.NotEqual(t, old.User("bob"), rotated.User("bob"), "New logins should use the new key")
+
+	stored, err := old.IP("82.233.123.117")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, stored, "82.233", "The ip address should be encrypted")
+	assert.Equal(t, "82.233.123.117", rotated.RevealIP(stored), "Ip addresses of the old key should still decrypt")
+}
+
+func TestTruncateIP(t *testing.T) {
+	assert.Equal(t, "82.233.123.0", TruncateIP("82.233.123.117"), "IPv4 addresses should keep their /24")
+	assert.Equal(t, "2001:db8:85a3::", TruncateIP("2001:db8:85a3:8d3:1319:8a2e:370:7348"), "IPv6 addresses should keep their /48")
+}
+
+func TestVisibleIP(t *testing.T) {
+	db := &DB{}
+	assert.Equal(t, "82.233.123.117", db.VisibleIP("82.233.123.117"))
+	for mode, want := range map[string]string{IPTruncate: "82.233.123.0", IPEncrypt: "82.233.123.117"} {
+		pseudo, err := NewPseudonymizer([]string{"k1:first-secret"}, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.UsePseudonymizer(pseudo)
+		assert.Equal(t, want, db.VisibleIP("82.233.123.117"), "Logins should give back the ip address as stored with %s", mode)
+	}
+}
+
+func TestPseudonymisedLoginsNextTo(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db, err := open([]string{"a.db", "b.db"}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseHandle()
+	pseudo, err := NewPseudonymizer([]string{"k1:first-secret"}, IPEncrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.UsePseudonymizer(pseudo)
+	tdb := db.ForTenant(DefaultTenant)
+	ctx := context.Background()
+	// A user whose logins are not in the first shard, where a lookup by the wrong username lands.
+	var user string
+	for u := 0; user == ""; u++ {
+		if name := fmt.Sprintf("user%d", u); db.shardFor(DefaultTenant, name).index == 1 {
+			user = name
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := tdb.InsertLogin(ctx, shardLogin(user, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lg, err := tdb.GetLoginByUUID(ctx, shardLogin(user, 1).EventUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, user, lg.UserName, "The login should be read back under its pseudonym")
+	before, err := tdb.GetLoginsNextTo(ctx, lg, "<", lg.UnixTimeStamp)
+	assert.Nil(t, err)
+	if assert.Len(t, *before, 1, "The login before a stored one should be found by its pseudonym") {
+		assert.Equal(t, shardLogin(user, 0).EventUUID, (*before)[0].EventUUID)
+	}
+	after, err := tdb.GetLoginsNextTo(ctx, lg, ">", lg.UnixTimeStamp)
+	assert.Nil(t, err)
+	if assert.Len(t, *after, 1, "The login after a stored one should be found by its pseudonym") {
+		assert.Equal(t, shardLogin(user, 2).EventUUID, (*after)[0].EventUUID)
+	}
+}
+
+func TestErasureSubjectIsKeyed(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ctx := context.Background()
+	subjects := make([]string, 0)
+	for _, name := range []string{"a.db", "b.db", "c.db"} {
+		db, err := open([]string{name}, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.CloseHandle()
+		if name == "c.db" {
+			pseudo, err := NewPseudonymizer([]string{"k1:first-secret"}, IPEncrypt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.UsePseudonymizer(pseudo)
+			assert.NotEqual(t, pseudo.User("bob"), db.subject("bob"), "The audit subject should not be the stored pseudonym")
+		}
+		tdb := db.ForTenant(DefaultTenant)
+		if err = tdb.InsertLogin(ctx, shardLogin("bob", 0)); err != nil {
+			t.Fatal(err)
+		}
+		erasure, err := tdb.EraseUser(ctx, "bob", "admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, int64(1), erasure.Logins)
+		assert.Equal(t, db.subject("bob"), erasure.Subject, "The subject should be stable for a database")
+		subjects = append(subjects, erasure.Subject)
+	}
+	sum := sha256.Sum256([]byte("bob"))
+	assert.NotContains(t, subjects, hex.EncodeToString(sum[:]), "The subject should not be an unkeyed hash")
+	assert.NotEqual(t, subjects[0], subjects[1], "Databases should key the subject with their own key")
+	assert.NotEqual(t, subjects[1], subjects[2])
+}
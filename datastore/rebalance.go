@@ -0,0 +1,295 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// rebalanceBatch is the most logins moved in one transaction.
+const rebalanceBatch = 500
+
+// moveColumns lists the logins columns copied when moving a login to another shard, which gets it
+// a new id there.
+var moveColumns = "tenant,slot," + strings.TrimPrefix(columns, "id,")
+
+// RebalanceReport tells what a rebalance did to each database file.
+type RebalanceReport struct {
+	Shards   []ShardReport `json:"shards"`
+	Moved    int64         `json:"moved"`
+	Unplaced int64         `json:"unplaced"`
+}
+
+// ShardReport tells what a rebalance did to one database file.
+type ShardReport struct {
+	Name    string `json:"name"`
+	Drained bool   `json:"drained,omitempty"`
+	// Slots is the number of slots the shard owns, Logins the number of logins it holds afterwards.
+	Slots  int   `json:"slots"`
+	Logins int64 `json:"logins"`
+	// MovedOut is the number of logins moved to the shards owning their slots. Unplaced is the
+	// number of logins left in place because their slot is unknown.
+	MovedOut int64 `json:"moved_out"`
+	Unplaced int64 `json:"unplaced"`
+}
+
+// Rebalance moves the logins between the database files so that every user's are in the shard
+// owning their slot on the ring of shards, the list the server is started with next. The files in
+// drain are no longer shards and all their logins are moved out. It must run while no server
+// uses the files. Each login is copied before it is deleted and not copied again when it is
+// already there, so an interrupted rebalance is completed by running it again.
+//
+// The slot of a login stored before logins had one is worked out from its username, unless the
+// usernames are pseudonymised. Those logins are left where they are and reported as unplaced. The
+// server moves them to the shard of their user, giving them their slot, when the logins of the user
+// are next read or erased. The api keys are only read from the first shard and are never moved.
+func Rebalance(ctx context.Context, shards, drain []string, pseudonymised bool) (*RebalanceReport, error) {
+	r, err := newRing(shards)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = newRing(append(append([]string{}, shards...), drain...)); err != nil {
+		return nil, err
+	}
+	for _, name := range drain {
+		if _, err = os.Stat(name); err != nil {
+			return nil, err
+		}
+	}
+	var files []*shard
+	defer func() {
+		for _, s := range files {
+			s.close()
+		}
+	}()
+	for i, name := range append(append([]string{}, shards...), drain...) {
+		s, err := openShard(i, name, Options{})
+		if err != nil {
+			return nil, fmt.Errorf("opening %s: %w", name, err)
+		}
+		files = append(files, s)
+	}
+	for _, s := range files[1:] {
+		var keys int
+		if err = s.dbh.QueryRowContext(ctx, "SELECT COUNT(*) FROM api_keys").Scan(&keys); err != nil {
+			return nil, err
+		}
+		if keys > 0 {
+			return nil, fmt.Errorf("%s holds api keys, which are only read from the first shard", s.name)
+		}
+	}
+
+	report := &RebalanceReport{}
+	slots := r.slots(len(shards))
+	for i, s := range files {
+		sr := ShardReport{Name: s.name, Drained: i >= len(shards)}
+		if !sr.Drained {
+			sr.Slots = slots[i]
+		}
+		if !pseudonymised {
+			if err = assignSlots(ctx, s); err != nil {
+				return nil, fmt.Errorf("assigning slots in %s: %w", s.name, err)
+			}
+		}
+		owned, err := storedSlots(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		for _, slot := range owned {
+			owner := r.owners[slot]
+			if owner == i {
+				continue
+			}
+			moved, err := moveSlot(ctx, s, files[owner], slot)
+			sr.MovedOut += moved
+			if err != nil {
+				return nil, fmt.Errorf("moving slot %d from %s to %s: %w", slot, s.name, files[owner].name, err)
+			}
+		}
+		if err = s.dbh.QueryRowContext(ctx, "SELECT COUNT(*) FROM logins WHERE slot<0").Scan(&sr.Unplaced); err != nil {
+			return nil, err
+		}
+		slog.Info("rebalanced shard", "shard", s.name, "moved_out", sr.MovedOut, "unplaced", sr.Unplaced)
+		report.Moved += sr.MovedOut
+		report.Unplaced += sr.Unplaced
+		report.Shards = append(report.Shards, sr)
+	}
+	for i, s := range files {
+		if err = s.dbh.QueryRowContext(ctx, "SELECT COUNT(*) FROM logins").Scan(&report.Shards[i].Logins); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// assignSlots gives the logins stored before logins had a slot the slot of their username.
+func assignSlots(ctx context.Context, s *shard) error {
+	rows, err := s.dbh.QueryContext(ctx, "SELECT DISTINCT tenant, username FROM logins WHERE slot<0")
+	if err != nil {
+		return err
+	}
+	var users [][2]string
+	for rows.Next() {
+		var user [2]string
+		if err = rows.Scan(&user[0], &user[1]); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	tx, err := s.dbh.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		_, err = tx.ExecContext(ctx, "UPDATE logins SET slot=? WHERE tenant=? AND username=? AND slot<0",
+			Slot(user[0], user[1]), user[0], user[1])
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// storedSlots returns the slots the shard holds logins of.
+func storedSlots(ctx context.Context, s *shard) ([]int, error) {
+	rows, err := s.dbh.QueryContext(ctx, "SELECT DISTINCT slot FROM logins WHERE slot>=0 ORDER BY slot")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var slots []int
+	for rows.Next() {
+		var slot int
+		if err = rows.Scan(&slot); err != nil {
+			return nil, err
+		}
+		slots = append(slots, slot)
+	}
+	return slots, rows.Err()
+}
+
+// moveSlot moves the logins of the slot from src to dst in batches, returning the number moved.
+func moveSlot(ctx context.Context, src, dst *shard, slot int) (int64, error) {
+	var moved int64
+	for {
+		ids, logins, err := readSlot(ctx, src, slot)
+		if err != nil || len(ids) == 0 {
+			return moved, err
+		}
+		if err = copyLogins(ctx, dst, logins); err != nil {
+			return moved, err
+		}
+		_, err = src.dbh.ExecContext(ctx, "DELETE FROM logins WHERE id IN ("+placeholders(len(ids))+")", ids...)
+		if err != nil {
+			return moved, err
+		}
+		moved += int64(len(ids))
+	}
+}
+
+// readSlot returns the ids and the moveColumns of a batch of the logins of the slot.
+func readSlot(ctx context.Context, s *shard, slot int) ([]interface{}, [][]interface{}, error) {
+	return readBatch(ctx, s, "slot=?", slot)
+}
+
+// readBatch returns the ids and the moveColumns of a batch of the logins matching the condition.
+func readBatch(ctx context.Context, s *shard, cond string, args ...interface{}) ([]interface{}, [][]interface{}, error) {
+	rows, err := s.dbh.QueryContext(ctx, "SELECT id,"+moveColumns+" FROM logins WHERE "+cond+" ORDER BY id LIMIT ?",
+		append(args, rebalanceBatch)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	n := strings.Count(moveColumns, ",") + 1
+	var ids []interface{}
+	var logins [][]interface{}
+	for rows.Next() {
+		var id int64
+		values := make([]interface{}, n)
+		dest := []interface{}{&id}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, nil, err
+		}
+		// The driver reads text as bytes, which would be written back as blobs.
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		ids = append(ids, id)
+		logins = append(logins, values)
+	}
+	return ids, logins, rows.Err()
+}
+
+// copyLogins inserts the logins into the shard in one transaction, skipping those a previous,
+// interrupted rebalance already copied.
+func copyLogins(ctx context.Context, s *shard, logins [][]interface{}) error {
+	n := strings.Count(moveColumns, ",") + 1
+	insert := "INSERT INTO logins (" + moveColumns + ") SELECT " + placeholders(n) + " WHERE NOT EXISTS " +
+		"(SELECT 1 FROM logins WHERE tenant=? AND username=? AND unix_timestamp=? AND event_uuid=?)"
+	tx, err := s.dbh.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, values := range logins {
+		// tenant, username, unix_timestamp and event_uuid are the first, third, fourth and fifth columns.
+		args := append(append([]interface{}{}, values...), values[0], values[2], values[3], values[4])
+		if _, err = tx.ExecContext(ctx, insert, args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// gatherUnplaced moves the logins of the user a rebalance left unplaced in the other shards to the
+// shard owning the slot of the user, under the current pseudonym and with that slot. Only logins
+// with pseudonymised usernames are left unplaced, and their user is only known once seen again.
+func (t *TenantDB) gatherUnplaced(ctx context.Context, username string) error {
+	if t.db.pseudo == nil || len(t.db.shards) == 1 {
+		return nil
+	}
+	users := t.db.users(username)
+	owner, slot := t.db.shardFor(t.tenant, username), Slot(t.tenant, username)
+	cond := "tenant=? AND slot<0 AND username IN (" + placeholders(len(users)) + ")"
+	args := append([]interface{}{t.tenant}, toArgs(users)...)
+	for _, s := range t.db.shards {
+		if s == owner {
+			continue
+		}
+		for {
+			ids, logins, err := readBatch(ctx, s, cond, args...)
+			if err != nil || len(ids) == 0 {
+				if err != nil {
+					return err
+				}
+				break
+			}
+			for _, values := range logins {
+				// slot and username are the second and third columns.
+				values[1], values[2] = slot, users[0]
+			}
+			if err = copyLogins(ctx, owner, logins); err != nil {
+				return err
+			}
+			_, err = s.dbh.ExecContext(ctx, "DELETE FROM logins WHERE id IN ("+placeholders(len(ids))+")", ids...)
+			if err != nil {
+				return err
+			}
+			slog.InfoContext(ctx, "gathered unplaced logins", "shard", s.name, "to", owner.name, "logins", len(ids))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// PurgeLogins deletes at most batchSize logins with an event time before cutoff, oldest first,
+// sparing the keepPerUser most recent logins of every user of every tenant, in each shard. It returns
+// the number of logins deleted, a count lower than batchSize means nothing is left to purge. The
+// speed of the oldest login left of a user was relative to a deleted login, and is reset in the
+// same transaction, as no login precedes it any more.
+func (db *DB) PurgeLogins(ctx context.Context, cutoff int64, keepPerUser, batchSize int) (int64, error) {
+	defer observe(ctx, "purge_logins", time.Now())
+	selectStmt := "SELECT id, tenant, username FROM LOGINS AS l WHERE l.unix_timestamp < ? " +
+		"ORDER BY l.unix_timestamp, l.id LIMIT ?"
+	args := []interface{}{cutoff, batchSize}
+	if keepPerUser > 0 {
+		selectStmt = "SELECT id, tenant, username FROM LOGINS AS l WHERE l.unix_timestamp < ? " +
+			"AND (SELECT COUNT(*) FROM LOGINS AS n WHERE n.tenant = l.tenant AND n.username = l.username " +
+			"AND n.unix_timestamp > l.unix_timestamp) >= ? ORDER BY l.unix_timestamp, l.id LIMIT ?"
+		args = []interface{}{cutoff, keepPerUser, batchSize}
+	}
+	// The total is below batchSize only when every shard is done.
+	var total int64
+	for _, s := range db.shards {
+		err := db.retry(ctx, "purge_logins", func() error {
+			tx, err := s.dbh.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			n, err := purgeBatch(ctx, tx, selectStmt, args)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			if err = tx.Commit(); err != nil {
+				return err
+			}
+			total += n
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("purging shard %s: %w", s.name, err)
+		}
+	}
+	return total, nil
+}
+
+// purgeBatch deletes the logins the statement selects and resets the speed of the oldest login left
+// of each of their users.
+func purgeBatch(ctx context.Context, tx *sql.Tx, selectStmt string, args []interface{}) (int64, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT DISTINCT tenant, username FROM ("+selectStmt+")", args...)
+	if err != nil {
+		return 0, err
+	}
+	var users [][2]string
+	for rows.Next() {
+		var user [2]string
+		if err = rows.Scan(&user[0], &user[1]); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM LOGINS WHERE id IN (SELECT id FROM ("+selectStmt+"))", args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	for _, user := range users {
+		_, err = tx.ExecContext(ctx, "UPDATE LOGINS SET speed=0 WHERE id=(SELECT id FROM LOGINS WHERE tenant=? "+
+			"AND username=? ORDER BY unix_timestamp, id LIMIT 1) AND speed<>0", user[0], user[1])
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,44 @@
+package datastore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPurgeResetsSpeedOfOldestLoginLeft(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ctx := context.Background()
+	db, err := open([]string{"a.db"}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseHandle()
+	tdb := db.ForTenant(DefaultTenant)
+	for i := 0; i < 4; i++ {
+		lg := shardLogin("bob", i)
+		lg.Speed = 100
+		if err := tdb.InsertLogin(ctx, lg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	purged, err := db.PurgeLogins(ctx, 1002, 0, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), purged, "The purge should stop at the batch size")
+	for i, speed := range map[int]float64{1: 0, 2: 100, 3: 100} {
+		lg, err := tdb.GetLoginByUUID(ctx, shardLogin("bob", i).EventUUID)
+		if assert.Nil(t, err) {
+			assert.Equal(t, speed, lg.Speed, "Only the oldest login left should have its speed reset")
+		}
+	}
+
+	purged, err = db.PurgeLogins(ctx, 1004, 2, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), purged, "The most recent logins of the user should be kept")
+	lg, err := tdb.GetLoginByUUID(ctx, shardLogin("bob", 2).EventUUID)
+	if assert.Nil(t, err) {
+		assert.Equal(t, float64(0), lg.Speed)
+	}
+}
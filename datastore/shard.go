@@ -0,0 +1,164 @@
+package datastore
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+const (
+	// slotCount is the number of slots the users are hashed into. Slots, not users, are assigned
+	// to shards, so that a rebalance moves the logins of whole slots.
+	slotCount = 1024
+	// maxShards bounds the number of shards, whose index is kept in the low bits of login ids.
+	maxShards = 1 << shardBits
+	shardBits = 8
+	// virtualNodes is the number of points each shard has on the hash ring, which evens out the
+	// number of slots each one owns.
+	virtualNodes = 128
+)
+
+// shard is one database file, holding the logins of the users whose slots it owns.
+type shard struct {
+	index int
+	name  string
+	// dbh is the single connection writes run on, rdb the pool of connections reads run on. Reads
+	// run on dbh when there is no pool.
+	dbh   *sql.DB
+	rdb   *sql.DB
+	batch *batcher
+}
+
+// reader returns the connections reads run on.
+func (s *shard) reader() *sql.DB {
+	if s.rdb != nil {
+		return s.rdb
+	}
+	return s.dbh
+}
+
+// close commits the pending writes, checkpoints the write ahead log into the database file and
+// closes the shard, so that the next start has no log to recover.
+func (s *shard) close() error {
+	if s.batch != nil {
+		s.batch.close()
+	}
+	if s.rdb != nil {
+		s.rdb.Close()
+	}
+	if _, err := s.dbh.Exec("PRAGMA wal_checkpoint(TRUNCATE);"); err != nil {
+		s.dbh.Close()
+		return err
+	}
+	return s.dbh.Close()
+}
+
+// Slot returns the slot the logins of the user are kept in. It hashes the raw username, so that
+// the slot does not depend on the pseudonym the username is stored under.
+func Slot(tenant, username string) int {
+	h := fnv.New32a()
+	h.Write([]byte(tenant))
+	h.Write([]byte{0})
+	h.Write([]byte(username))
+	return int(h.Sum32() % slotCount)
+}
+
+// ring assigns the slots to shards by consistent hashing over the shard names. Adding a shard
+// only moves slots to the new one and removing one only moves the slots it owned.
+type ring struct {
+	owners [slotCount]int
+}
+
+func newRing(names []string) (*ring, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("datastore: no shards")
+	}
+	if len(names) > maxShards {
+		return nil, fmt.Errorf("datastore: %d shards, at most %d are supported", len(names), maxShards)
+	}
+	type point struct {
+		hash  uint64
+		shard int
+	}
+	points := make([]point, 0, len(names)*virtualNodes)
+	seen := make(map[string]bool, len(names))
+	for i, name := range names {
+		if seen[name] {
+			return nil, fmt.Errorf("datastore: shard %s is listed twice", name)
+		}
+		seen[name] = true
+		for v := 0; v < virtualNodes; v++ {
+			points = append(points, point{hash64(fmt.Sprintf("%s#%d", name, v)), i})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	r := &ring{}
+	for slot := range r.owners {
+		h := hash64(fmt.Sprintf("slot#%d", slot))
+		i := sort.Search(len(points), func(i int) bool { return points[i].hash >= h })
+		r.owners[slot] = points[i%len(points)].shard
+	}
+	return r, nil
+}
+
+// hash64 places a key on the ring. FNV clusters similar keys such as the virtual nodes of a shard,
+// so the ring, built once, uses SHA-256.
+func hash64(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// slots returns the number of slots each of the n shards owns.
+func (r *ring) slots(n int) []int {
+	counts := make([]int, n)
+	for _, owner := range r.owners {
+		counts[owner]++
+	}
+	return counts
+}
+
+// primary returns the first shard, which also holds the api keys and the audit log.
+func (db *DB) primary() *shard {
+	return db.shards[0]
+}
+
+// shardFor returns the shard holding the logins of the user.
+func (db *DB) shardFor(tenant, username string) *shard {
+	if len(db.shards) == 1 {
+		return db.shards[0]
+	}
+	return db.shards[db.ring.owners[Slot(tenant, username)]]
+}
+
+// loginID returns the id a login stored in the shard under the given row id is known by, which
+// tells the shard back.
+func loginID(s *shard, rowID int64) int64 {
+	return rowID<<shardBits | int64(s.index)
+}
+
+// shardOfLogin returns the shard a login id is stored in and its row id there.
+func (db *DB) shardOfLogin(id int64) (*shard, int64, error) {
+	index := int(id & (maxShards - 1))
+	if index >= len(db.shards) {
+		return nil, 0, fmt.Errorf("datastore: login id %d refers to shard %d of %d", id, index, len(db.shards))
+	}
+	return db.shards[index], id >> shardBits, nil
+}
+
+// ParseShards returns the database files listed, separated by commas, or file alone when none are.
+func ParseShards(list, file string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return []string{file}
+	}
+	return names
+}
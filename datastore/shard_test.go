@@ -0,0 +1,213 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingMovesSlotsOnlyToAddedShard(t *testing.T) {
+	two, err := newRing([]string{"a.db", "b.db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	three, err := newRing([]string{"a.db", "b.db", "c.db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for slot := range three.owners {
+		if three.owners[slot] != two.owners[slot] {
+			assert.Equal(t, 2, three.owners[slot], "Slot %d should only move to the added shard", slot)
+		}
+	}
+	for i, n := range three.slots(3) {
+		assert.True(t, n > slotCount/6, "Shard %d owns only %d slots", i, n)
+	}
+	_, err = newRing([]string{"a.db", "a.db"})
+	assert.NotNil(t, err, "A shard listed twice should be rejected")
+}
+
+func TestParseShards(t *testing.T) {
+	assert.Equal(t, []string{"logins.db"}, ParseShards("", "logins.db"))
+	assert.Equal(t, []string{"a.db", "b.db"}, ParseShards(" a.db, b.db,", "logins.db"))
+}
+
+// shardLogin returns a login of the user, a distinct one for each i.
+func shardLogin(user string, i int) *LoginEntryDAO {
+	return &LoginEntryDAO{LoginRequestDAO: LoginRequestDAO{UserName: user, UnixTimeStamp: int64(1000 + i),
+		EventUUID: fmt.Sprintf("85ad929a-db03-4bf4-9541-%s-%d", user, i), IpAddress: "10.0.0.1"}}
+}
+
+// countLogins returns the number of logins of the user stored in the shard.
+func countLogins(t *testing.T, s *shard, user string) int {
+	var n int
+	if err := s.dbh.QueryRow("SELECT COUNT(*) FROM logins WHERE username=?", user).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestShardedLogins(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db, err := open([]string{"a.db", "b.db"}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseHandle()
+	tdb := db.ForTenant(DefaultTenant)
+	ctx := context.Background()
+	users := make([]string, 20)
+	for u := range users {
+		users[u] = fmt.Sprintf("user%d", u)
+		for i := 0; i < 3; i++ {
+			if err := tdb.InsertLogin(ctx, shardLogin(users[u], i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	used := map[int]bool{}
+	for _, user := range users {
+		s := db.shardFor(DefaultTenant, user)
+		used[s.index] = true
+		assert.Equal(t, 3, countLogins(t, s, user), "The logins of %s should be in its shard", user)
+		logins, err := tdb.GetLoginsForUserGreaterThanOrLessThan(ctx, user, ">", 0)
+		assert.Nil(t, err)
+		assert.Len(t, *logins, 3)
+	}
+	assert.Len(t, used, 2, "The users should be spread over both shards")
+
+	var user string
+	for _, u := range users {
+		if db.shardFor(DefaultTenant, u).index == 1 {
+			user = u
+			break
+		}
+	}
+	lg, err := tdb.GetLoginByUUID(ctx, shardLogin(user, 1).EventUUID)
+	assert.Nil(t, err)
+	if assert.NotNil(t, lg, "Logins should be found by uuid in any shard") {
+		assert.Nil(t, tdb.UpdateLoginSpeed(ctx, lg.ID, 42))
+		next, _ := tdb.GetLoginByUUID(ctx, shardLogin(user, 2).EventUUID)
+		assert.Nil(t, tdb.DeleteLogin(ctx, lg.ID, next.ID, 7))
+		next, _ = tdb.GetLoginByUUID(ctx, shardLogin(user, 2).EventUUID)
+		assert.Equal(t, float64(7), next.Speed, "The login after the deleted one should be updated in its shard")
+		assert.Equal(t, 2, countLogins(t, db.shards[1], user))
+	}
+
+	purged, err := db.PurgeLogins(ctx, 1001, 0, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(users)), purged, "Every shard should be purged")
+}
+
+func TestRebalance(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ctx := context.Background()
+	db, err := open([]string{"a.db"}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tdb := db.ForTenant(DefaultTenant)
+	for u := 0; u < 20; u++ {
+		for i := 0; i < 3; i++ {
+			if err := tdb.InsertLogin(ctx, shardLogin(fmt.Sprintf("user%d", u), i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// A login stored before logins had a slot.
+	_, err = db.primary().dbh.Exec("INSERT INTO logins (tenant, username, unix_timestamp, event_uuid, ip_address, lat, lon, " +
+		"radius, speed) VALUES ('default', 'legacy', 1000, 'legacy-event', '10.0.0.1', 0, 0, 0, 0)")
+	assert.Nil(t, err)
+	assert.Nil(t, db.CloseHandle())
+
+	report, err := Rebalance(ctx, []string{"a.db", "b.db"}, nil, true)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), report.Unplaced, "The slot of a pseudonymised login cannot be worked out")
+	report, err = Rebalance(ctx, []string{"a.db", "b.db"}, nil, false)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), report.Unplaced)
+	assert.Equal(t, int64(61), report.Shards[0].Logins+report.Shards[1].Logins, "No login should be lost")
+	assert.Equal(t, slotCount, report.Shards[0].Slots+report.Shards[1].Slots)
+
+	report, err = Rebalance(ctx, []string{"a.db", "b.db"}, nil, false)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), report.Moved, "A balanced set of shards should be left as is")
+
+	db, err = open([]string{"a.db", "b.db"}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"user0", "user7", "user13", "legacy"} {
+		logins, err := db.ForTenant(DefaultTenant).GetLoginsForUserGreaterThanOrLessThan(ctx, user, ">", 0)
+		assert.Nil(t, err)
+		assert.NotEmpty(t, *logins, "The logins of %s should be found in its shard", user)
+	}
+	assert.Nil(t, db.CloseHandle())
+
+	report, err = Rebalance(ctx, []string{"b.db"}, []string{"a.db"}, false)
+	assert.Nil(t, err)
+	assert.True(t, report.Shards[1].Drained)
+	assert.Equal(t, int64(0), report.Shards[1].Logins, "A drained file should be emptied")
+	assert.Equal(t, int64(61), report.Shards[0].Logins)
+
+	t.Run("pseudonymised", func(t *testing.T) {
+		t.Chdir(t.TempDir())
+		pseudo, err := NewPseudonymizer([]string{"k1:first-secret"}, IPEncrypt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ring, err := newRing([]string{"a.db", "b.db"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A user whose slot moves to the added shard.
+		user := "user0"
+		for u := 1; ring.owners[Slot(DefaultTenant, user)] != 1; u++ {
+			user = fmt.Sprintf("user%d", u)
+		}
+		db, err := open([]string{"a.db"}, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.primary().dbh.Exec("INSERT INTO logins (tenant, username, unix_timestamp, event_uuid, ip_address, "+
+			"lat, lon, radius, speed) VALUES ('default', ?, 1000, 'legacy-event', '10.0.0.1', 0, 0, 0, 0)", pseudo.User(user))
+		assert.Nil(t, err)
+		assert.Nil(t, db.CloseHandle())
+
+		report, err := Rebalance(ctx, []string{"a.db", "b.db"}, nil, true)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1), report.Unplaced)
+
+		db, err = open([]string{"a.db", "b.db"}, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.CloseHandle()
+		db.UsePseudonymizer(pseudo)
+		tdb := db.ForTenant(DefaultTenant)
+		logins, err := tdb.GetLoginsForUserGreaterThanOrLessThan(ctx, user, "<", 2000)
+		assert.Nil(t, err)
+		assert.Len(t, *logins, 1, "The unplaced login should be found from the shard of its user")
+		assert.Equal(t, 0, countLogins(t, db.shards[0], pseudo.User(user)))
+		assert.Equal(t, 1, countLogins(t, db.shards[1], pseudo.User(user)), "The login should be moved to its user's shard")
+		var slot int
+		assert.Nil(t, db.shards[1].dbh.QueryRow("SELECT slot FROM logins WHERE event_uuid='legacy-event'").Scan(&slot))
+		assert.Equal(t, Slot(DefaultTenant, user), slot, "The login should be given the slot of its user")
+
+		// Erasure finds the logins left unplaced as well.
+		_, err = db.primary().dbh.Exec("INSERT INTO logins (tenant, username, unix_timestamp, event_uuid, ip_address, "+
+			"lat, lon, radius, speed) VALUES ('default', ?, 500, 'older-event', '10.0.0.2', 0, 0, 0, 0)", pseudo.User(user))
+		assert.Nil(t, err)
+		erasure, err := tdb.EraseUser(ctx, user, "admin")
+		assert.Nil(t, err)
+		assert.Len(t, erasure.IpAddresses, 2)
+		assert.Equal(t, 0, countLogins(t, db.shards[0], pseudo.User(user))+countLogins(t, db.shards[1], pseudo.User(user)))
+		for i, want := range []int{1, 0} {
+			var audits int
+			assert.Nil(t, db.shards[i].dbh.QueryRow("SELECT COUNT(*) FROM audit_log WHERE action=?", ActionErasure).Scan(&audits))
+			assert.Equal(t, want, audits, "The erasure should be audited in the first shard only")
+		}
+	})
+}
@@ -0,0 +1,234 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/anyaddres/supermann/logging"
+)
+
+// DefaultTenant owns the logins of requests that name no tenant, including every login stored
+// before tenants were introduced.
+const DefaultTenant = "default"
+
+// AnyTenant is the tenant of the api keys that are bound to no tenant, whose requests name the tenant
+// they act for.
+const AnyTenant = "*"
+
+// TenantDB is the view of the DB for a single tenant. Logins are only reachable through it and
+// every query it runs is restricted to the rows of its tenant.
+type TenantDB struct {
+	db     *DB
+	tenant string
+}
+
+// ForTenant returns the view of the DB for the given tenant.
+func (db *DB) ForTenant(tenant string) *TenantDB {
+	return &TenantDB{db: db, tenant: tenant}
+}
+
+// Tenant returns the tenant of the view.
+func (t *TenantDB) Tenant() string {
+	return t.tenant
+}
+
+// InsertLogin ...
+func (t *TenantDB) InsertLogin(ctx context.Context, lg *LoginEntryDAO) error {
+	defer observe(ctx, "insert_login", time.Now())
+	return t.db.retry(ctx, "insert_login", func() error {
+		return t.insertLogin(ctx, lg)
+	})
+}
+
+func (t *TenantDB) insertLogin(ctx context.Context, lg *LoginEntryDAO) error {
+	ipAddress := lg.IpAddress
+	if t.db.pseudo != nil {
+		var err error
+		if ipAddress, err = t.db.pseudo.IP(lg.IpAddress); err != nil {
+			return err
+		}
+	}
+	users := t.db.users(lg.UserName)
+	username := users[0]
+	slot := Slot(t.tenant, lg.UserName)
+	InsStmt := "INSERT INTO  LOGINS(tenant, username, unix_timestamp, event_uuid, ip_address, lat,lon,radius,speed," +
+		"country,country_name,subdivision,subdivision_name,city,postal_code,time_zone,slot)" +
+		"VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17)"
+	// The insert is committed with the concurrent ones and returns once it is. Its statements run
+	// detached from the request, whose end would otherwise roll back the inserts of other requests.
+	stmtCtx := context.WithoutCancel(ctx)
+	return t.db.shardFor(t.tenant, lg.UserName).write(ctx, func(tx *sql.Tx) error {
+		// Move the user's logins stored under rotated out keys to the current one, and give the
+		// logins stored before they had a slot theirs, which a pseudonym no longer tells. Those a
+		// rebalance left in other shards were moved here when the user's logins were read.
+		if t.db.pseudo != nil {
+			_, err := tx.ExecContext(stmtCtx, "UPDATE LOGINS SET username=?, slot=? WHERE tenant=? AND username IN ("+
+				placeholders(len(users))+") AND (username<>? OR slot<>?)",
+				append([]interface{}{username, slot, t.tenant}, toArgs(users, username, slot)...)...)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.ExecContext(stmtCtx, InsStmt, t.tenant, username, lg.UnixTimeStamp, lg.EventUUID, ipAddress,
+			lg.Lat, lg.Lon, lg.Radius, lg.Speed, lg.Country, lg.CountryName, lg.Subdivision, lg.SubdivisionName,
+			lg.City, lg.PostalCode, lg.TimeZone, slot)
+		return err
+	})
+}
+
+// GetLoginsForUserGreaterThanOrLessThan ...
+func (t *TenantDB) GetLoginsForUserGreaterThanOrLessThan(ctx context.Context, username, operator string, ts int64) (*[]LoginEntryDAO, error) {
+	if err := t.db.retry(ctx, "gather_unplaced", func() error { return t.gatherUnplaced(ctx, username) }); err != nil {
+		return nil, err
+	}
+	return t.neighbours(ctx, t.db.shardFor(t.tenant, username), t.db.users(username), operator, ts)
+}
+
+// GetLoginsNextTo returns the logins of the user of a login read back from the DB with an event time
+// after or before ts, as operator says. They are looked up by the username the login is stored under,
+// which is a pseudonym when usernames are pseudonymised, in the shard holding it.
+func (t *TenantDB) GetLoginsNextTo(ctx context.Context, lg *LoginEntryDAO, operator string, ts int64) (*[]LoginEntryDAO, error) {
+	s, _, err := t.db.shardOfLogin(lg.ID)
+	if err != nil {
+		return nil, classify("logins_next_to", err)
+	}
+	return t.neighbours(ctx, s, []string{lg.UserName}, operator, ts)
+}
+
+// neighbours returns the logins stored in the shard under any of the usernames after or before ts.
+func (t *TenantDB) neighbours(ctx context.Context, s *shard, users []string, operator string, ts int64) (*[]LoginEntryDAO, error) {
+	op := "logins_after"
+	if operator == "<" {
+		op = "logins_before"
+	}
+	defer observe(ctx, op, time.Now())
+	var results []LoginEntryDAO
+	err := t.db.retry(ctx, op, func() (err error) {
+		results, err = t.getLogins(ctx, s, users, operator, ts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	rowsReturned.With(op).Observe(float64(len(results)))
+	slog.DebugContext(ctx, "neighbouring logins read", "op", op, logging.KeyUser, users[0], "rows", len(results))
+	return &results, nil
+}
+
+func (t *TenantDB) getLogins(ctx context.Context, s *shard, users []string, operator string, ts int64) ([]LoginEntryDAO, error) {
+	selectStmt := "SELECT " + columns + " from LOGINS where tenant=? AND username IN (" + placeholders(len(users)) +
+		") AND unix_timestamp " + operator + " ?;"
+	args := append([]interface{}{t.tenant}, toArgs(users, strconv.FormatInt(ts, 10))...)
+	rows, err := s.reader().QueryContext(ctx, selectStmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := make([]LoginEntryDAO, 0)
+	for rows.Next() {
+		lg, err := t.db.scanLogin(s, rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, *lg)
+	}
+	// A query interrupted by its context stops the rows early.
+	return results, rows.Err()
+}
+
+// GetLoginByUUID returns the login stored under the given event uuid. It returns ErrNotFound
+// when no such event exists. The event uuid does not tell the user, so every shard is asked.
+func (t *TenantDB) GetLoginByUUID(ctx context.Context, eventUUID string) (lg *LoginEntryDAO, err error) {
+	defer observe(ctx, "get_login_by_uuid", time.Now())
+	err = t.db.retry(ctx, "get_login_by_uuid", func() error {
+		for _, s := range t.db.shards {
+			if lg, err = t.getLoginByUUID(ctx, s, eventUUID); lg != nil || err != nil {
+				return err
+			}
+		}
+		return ErrNotFound
+	})
+	return lg, err
+}
+
+func (t *TenantDB) getLoginByUUID(ctx context.Context, s *shard, eventUUID string) (*LoginEntryDAO, error) {
+	selectStmt := "SELECT " + columns + " from LOGINS where tenant=? AND event_uuid=? ORDER BY id LIMIT 1;"
+	rows, err := s.reader().QueryContext(ctx, selectStmt, t.tenant, eventUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return t.db.scanLogin(s, rows)
+}
+
+// UpdateLoginSpeed overwrites the stored speed of the login with the given id.
+func (t *TenantDB) UpdateLoginSpeed(ctx context.Context, id int64, speed float64) error {
+	defer observe(ctx, "update_login_speed", time.Now())
+	s, rowID, err := t.db.shardOfLogin(id)
+	if err != nil {
+		return classify("update_login_speed", err)
+	}
+	return t.db.retry(ctx, "update_login_speed", func() error {
+		_, err := s.dbh.ExecContext(ctx, "UPDATE LOGINS SET speed=? WHERE tenant=? AND id=?", speed, t.tenant, rowID)
+		return err
+	})
+}
+
+// DeleteLogin removes the login with the given id. If next is not zero the stored speed of that
+// login is set to nextSpeed within the same transaction, so that the subsequent event never
+// refers to a login that no longer exists. Both logins are of the same user, so in the same shard.
+// It returns ErrNotFound when no login has the id.
+func (t *TenantDB) DeleteLogin(ctx context.Context, id, next int64, nextSpeed float64) error {
+	defer observe(ctx, "delete_login", time.Now())
+	s, rowID, err := t.db.shardOfLogin(id)
+	if err != nil {
+		return classify("delete_login", err)
+	}
+	var nextRowID int64
+	if next != 0 {
+		nextShard, nextID, err := t.db.shardOfLogin(next)
+		if err != nil {
+			return classify("delete_login", err)
+		}
+		if nextShard != s {
+			return classify("delete_login", fmt.Errorf("datastore: logins %d and %d are in different shards", id, next))
+		}
+		nextRowID = nextID
+	}
+	return t.db.retry(ctx, "delete_login", func() error {
+		return t.deleteLogin(ctx, s, rowID, nextRowID, nextSpeed)
+	})
+}
+
+func (t *TenantDB) deleteLogin(ctx context.Context, s *shard, rowID, nextRowID int64, nextSpeed float64) error {
+	tx, err := s.dbh.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM LOGINS WHERE tenant=? AND id=?", t.tenant, rowID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		if err == nil {
+			err = ErrNotFound
+		}
+		return err
+	}
+	if nextRowID != 0 {
+		if _, err = tx.ExecContext(ctx, "UPDATE LOGINS SET speed=? WHERE tenant=? AND id=?", nextSpeed, t.tenant, nextRowID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -1,34 +1,288 @@
 package geoip
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/anyaddres/supermann/config"
+	"github.com/anyaddres/supermann/metrics"
+)
 
-	"github.com/oschwald/maxminddb-golang"
+var (
+	reloads = metrics.NewCounterVec("superman_geoip_reloads_total",
+		"GeoIP database reloads by result, ok or failed.", "result")
+	buildEpoch = metrics.NewGaugeVec("superman_geoip_build_epoch_seconds",
+		"Build time of each loaded GeoIP database.", "kind", "path")
 )
 
-// GeoIP Struct encompassing the maxmind db reader
+// GeoIP Struct encompassing the configured provider. The provider is replaced when the databases
+// are reloaded, lookups in flight finish on the provider they started with, which is closed after
+// them.
 type GeoIP struct {
-	GDB *maxminddb.Reader
+	specs     []SourceSpec
+	languages []string
+
+	mutex      sync.RWMutex
+	current    *reader
+	generation uint64
+	files      map[string]fileVersion
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// reader is a loaded provider along with the lookups running on it.
+type reader struct {
+	provider Provider
+	loadedAt time.Time
+	lookups  sync.WaitGroup
+}
+
+// fileVersion tells whether a database file was replaced.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
 }
 
-var gip *GeoIP
+// Info describes the loaded databases, generation is zero until they are loaded.
+type Info struct {
+	Sources    []Source  `json:"sources"`
+	LoadedAt   time.Time `json:"loadedAt,omitzero"`
+	Generation uint64    `json:"generation"`
+}
 
-// NewGeoIP Singleton Pattern for the GeoIP Handle
-func NewGeoIP(cfg *config.Config) *GeoIP {
+var (
+	gip      *GeoIP
+	gipMutex sync.Mutex
+)
+
+// NewGeoIP Singleton Pattern for the GeoIP Handle. The files are watched for changes every
+// GeoIPReloadInterval unless that is zero. A failure to open them matches ErrUnavailable, and the
+// next call tries again.
+func NewGeoIP(cfg *config.Config) (*GeoIP, error) {
+	gipMutex.Lock()
+	defer gipMutex.Unlock()
 	if gip != nil {
-		return gip
+		return gip, nil
+	}
+	database, err := Open(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	if cfg.GeoIPReloadInterval > 0 {
+		database.watch(cfg.GeoIPReloadInterval)
+	}
+	database.publish()
+	gip = database
+	return gip, nil
+}
+
+// Specs returns the sources of GEO_IP_PROVIDERS, or the MaxMind database GEO_IP_DB when it is
+// not set, preceded by the overrides file GEO_IP_OVERRIDES when there is one.
+func Specs(cfg *config.Config) ([]SourceSpec, error) {
+	specs := []SourceSpec{{Kind: KindMaxMind, Path: cfg.GeoIPDB}}
+	if cfg.GeoIPProviders != "" {
+		var err error
+		if specs, err = ParseSources(cfg.GeoIPProviders); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.GeoIPOverrides != "" {
+		specs = append([]SourceSpec{{Kind: KindOverride, Path: cfg.GeoIPOverrides}}, specs...)
+	}
+	return specs, nil
+}
+
+// Languages returns the languages of GEO_IP_LANGUAGES in order of preference.
+func Languages(cfg *config.Config) []string {
+	var languages []string
+	for _, language := range strings.Split(cfg.GeoIPLanguages, ",") {
+		if language = strings.TrimSpace(language); language != "" {
+			languages = append(languages, language)
+		}
 	}
-	database, err := maxminddb.Open(cfg.GeoIPDB)
+	return languages
+}
+
+// Open opens the configured databases without touching the singleton.
+func Open(cfg *config.Config) (*GeoIP, error) {
+	specs, err := Specs(cfg)
 	if err != nil {
-		log.Fatalf("GeoIP File not present %s", cfg.GeoIPDB)
+		return nil, err
+	}
+	g := &GeoIP{specs: specs, languages: Languages(cfg)}
+	if err := g.load(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Reload opens the database files again and swaps them in. The databases in use are kept when one
+// of the files cannot be opened.
+func (g *GeoIP) Reload() (Info, error) {
+	if err := g.load(); err != nil {
+		reloads.With("failed").Inc()
+		return g.Info(), err
+	}
+	info := g.Info()
+	reloads.With("ok").Inc()
+	g.publish()
+	for _, source := range info.Sources {
+		slog.Info("reloaded GeoIP database", "kind", source.Kind, "path", source.Path, "type", source.DatabaseType,
+			"build_epoch", source.BuildEpoch, "generation", info.Generation)
+	}
+	return info, nil
+}
+
+// publish sets the build time metric of each database.
+func (g *GeoIP) publish() {
+	for _, source := range g.Info().Sources {
+		buildEpoch.With(source.Kind, source.Path).Set(float64(source.BuildEpoch))
 	}
-	gip = &GeoIP{GDB: database}
-	return gip
 }
 
-// CloseGeoIPHandle ...
-func (geoip *GeoIP) CloseGeoIPHandle() {
-	geoip.GDB.Close()
+// load opens the database files and makes them the current provider.
+func (g *GeoIP) load() error {
+	files := make(map[string]fileVersion, len(g.specs))
+	for _, spec := range g.specs {
+		stat, err := os.Stat(spec.Path)
+		if err != nil {
+			return err
+		}
+		files[spec.Path] = fileVersion{modTime: stat.ModTime(), size: stat.Size()}
+	}
+	provider, err := openChain(g.specs, g.languages)
+	if err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	old := g.current
+	g.current = &reader{provider: provider, loadedAt: time.Now()}
+	g.generation++
+	g.files = files
+	g.mutex.Unlock()
+	if old != nil {
+		go old.close()
+	}
+	return nil
+}
+
+// close closes the provider once the lookups running on it are done.
+func (r *reader) close() error {
+	r.lookups.Wait()
+	return r.provider.Close()
+}
+
+// acquire returns the current reader, which is kept open until its lookup is marked done.
+func (g *GeoIP) acquire() (*reader, uint64) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	if g.current == nil {
+		return nil, g.generation
+	}
+	g.current.lookups.Add(1)
+	return g.current, g.generation
+}
+
+// Lookup returns the location of the ip address, or ErrNotFound when no database has one. It also
+// returns the generation of the databases the answer came from, which changes with each reload.
+func (g *GeoIP) Lookup(ctx context.Context, ip net.IP) (*Location, uint64, error) {
+	r, generation := g.acquire()
+	if r == nil {
+		return nil, generation, errors.New("GeoIP database is closed")
+	}
+	defer r.lookups.Done()
+	loc, err := r.provider.Lookup(ctx, ip)
+	return loc, generation, err
+}
+
+// Generation returns the number of times the databases were loaded.
+func (g *GeoIP) Generation() uint64 {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.generation
+}
+
+// Info describes the loaded databases.
+func (g *GeoIP) Info() Info {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	info := Info{Generation: g.generation}
+	if g.current != nil {
+		info.Sources, info.LoadedAt = g.current.provider.Sources(), g.current.loadedAt
+	}
+	return info
+}
+
+// Check verifies that the databases can be searched by looking up a well known address.
+func (g *GeoIP) Check(ctx context.Context) error {
+	_, _, err := g.Lookup(ctx, net.ParseIP("8.8.8.8"))
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// watch reloads the databases whenever one of their files changes. Updates should replace a file
+// by renaming a new one over it, a MaxMind file in use is memory mapped and must not be written to.
+func (g *GeoIP) watch(interval time.Duration) {
+	g.stop, g.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(g.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-g.stop:
+				return
+			case <-ticker.C:
+			}
+			if !g.changed() {
+				continue
+			}
+			if _, err := g.Reload(); err != nil {
+				slog.Error("reloading the GeoIP databases failed", "error", err)
+			}
+		}
+	}()
+}
+
+func (g *GeoIP) changed() bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	for path, version := range g.files {
+		stat, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !stat.ModTime().Equal(version.modTime) || stat.Size() != version.size {
+			return true
+		}
+	}
+	return false
+}
+
+// CloseGeoIPHandle stops watching the files and closes the databases once the running lookups are
+// done.
+func (g *GeoIP) CloseGeoIPHandle() error {
+	if g.stop != nil {
+		close(g.stop)
+		<-g.done
+		g.stop = nil
+	}
+	g.mutex.Lock()
+	current := g.current
+	g.current = nil
+	g.mutex.Unlock()
+	if current == nil {
+		return nil
+	}
+	return current.close()
 }
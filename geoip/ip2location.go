@@ -0,0 +1,212 @@
+package geoip
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"time"
+)
+
+// IP2Location reads an IP2Location BIN database of type DB5 or above, the types holding latitude
+// and longitude, except DB7. Rows are binary searched in the file rather than read into memory.
+// Place names are in English, the only language of these databases.
+type IP2Location struct {
+	path string
+	f    *os.File
+	meta ip2LocationHeader
+}
+
+// ip2LocationHeader is the start of a BIN file. Its addresses count from 1.
+type ip2LocationHeader struct {
+	DBType    uint8
+	DBColumn  uint8
+	Year      uint8
+	Month     uint8
+	Day       uint8
+	IPv4Count uint32
+	IPv4Addr  uint32
+	IPv6Count uint32
+	IPv6Addr  uint32
+	IPv4Index uint32
+	IPv6Index uint32
+}
+
+const (
+	// ip2LocationCountryColumn and the others are the columns of the fields, the address the range
+	// starts with being the first.
+	ip2LocationCountryColumn   = 2
+	ip2LocationRegionColumn    = 3
+	ip2LocationCityColumn      = 4
+	ip2LocationLatitudeColumn  = 5
+	ip2LocationLongitudeColumn = 6
+)
+
+// OpenIP2Location opens the BIN database at path.
+func OpenIP2Location(path string) (*IP2Location, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	db := &IP2Location{path: path, f: f}
+	header := make([]byte, 29)
+	if _, err = f.ReadAt(header, 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("geoip: %s: reading the header: %w", path, err)
+	}
+	binary.Read(bytes.NewReader(header), binary.LittleEndian, &db.meta)
+	if db.meta.DBType < 5 || db.meta.DBType == 7 || db.meta.DBColumn < ip2LocationLongitudeColumn {
+		f.Close()
+		return nil, fmt.Errorf("geoip: %s: IP2Location DB%d has no coordinates", path, db.meta.DBType)
+	}
+	return db, nil
+}
+
+// Lookup binary searches the rows of the address family of ip. Ranges without a country have no
+// location.
+func (d *IP2Location) Lookup(ctx context.Context, ip net.IP) (*Location, error) {
+	if ip == nil {
+		return nil, errors.New("geoip: invalid ip address")
+	}
+	key, count, base, width := ip.To4(), d.meta.IPv4Count, d.meta.IPv4Addr, 4
+	if key == nil {
+		key, count, base, width = ip.To16(), d.meta.IPv6Count, d.meta.IPv6Addr, 16
+	}
+	if count == 0 {
+		return nil, ErrNotFound
+	}
+	rowSize := int64(d.meta.DBColumn)*4 + int64(width) - 4
+	// The end of each range is the start of the next, the last range includes the last address.
+	last := bytes.Repeat([]byte{0xff}, width)
+	if bytes.Equal(key, last) {
+		key = decrement(key)
+	}
+	low, high := int64(0), int64(count)
+	for low <= high {
+		mid := (low + high) / 2
+		row := int64(base) - 1 + mid*rowSize
+		from, err := d.readIP(row, width)
+		if err != nil {
+			return nil, err
+		}
+		to, err := d.readIP(row+rowSize, width)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case bytes.Compare(key, from) < 0:
+			high = mid - 1
+		case bytes.Compare(key, to) >= 0:
+			low = mid + 1
+		default:
+			loc, err := d.readLocation(row + int64(width))
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(to, last) {
+				to = decrement(to)
+			}
+			loc.Network = rangeNetwork(ip, from, to)
+			return loc, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// readIP reads a little endian address of width bytes at off, returning it big endian.
+func (d *IP2Location) readIP(off int64, width int) (net.IP, error) {
+	b := make([]byte, width)
+	if _, err := d.f.ReadAt(b, off); err != nil {
+		return nil, err
+	}
+	for i, j := 0, width-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b, nil
+}
+
+// readLocation reads the fields of the row whose second column is at off.
+func (d *IP2Location) readLocation(off int64) (*Location, error) {
+	fields := make([]byte, (int(d.meta.DBColumn)-1)*4)
+	if _, err := d.f.ReadAt(fields, off); err != nil {
+		return nil, err
+	}
+	column := func(n int) uint32 {
+		return binary.LittleEndian.Uint32(fields[(n-2)*4:])
+	}
+	// The country code is followed by the country name, three bytes further.
+	country := int64(column(ip2LocationCountryColumn))
+	var names [4]string
+	for i, off := range []int64{country, country + 3, int64(column(ip2LocationRegionColumn)),
+		int64(column(ip2LocationCityColumn))} {
+		name, err := d.readString(off)
+		if err != nil {
+			return nil, err
+		}
+		names[i] = name
+	}
+	if names[0] == "-" || names[0] == "" {
+		return nil, ErrNotFound
+	}
+	return &Location{Latitude: roundCoordinate(math.Float32frombits(column(ip2LocationLatitudeColumn))),
+		Longitude: roundCoordinate(math.Float32frombits(column(ip2LocationLongitudeColumn))),
+		Country:   names[0], CountryName: names[1], SubdivisionName: names[2], City: names[3],
+		Source: KindIP2Location}, nil
+}
+
+// readString reads a string prefixed with its length at off, which counts from 0.
+func (d *IP2Location) readString(off int64) (string, error) {
+	length := make([]byte, 1)
+	if _, err := d.f.ReadAt(length, off); err != nil {
+		return "", err
+	}
+	s := make([]byte, length[0])
+	if _, err := d.f.ReadAt(s, off+1); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+// roundCoordinate drops the noise of the single precision the coordinates are stored with, which
+// holds five decimals, about a metre, for any longitude.
+func roundCoordinate(f float32) float64 {
+	return math.Round(float64(f)*1e5) / 1e5
+}
+
+func increment(ip []byte) []byte {
+	out := append([]byte(nil), ip...)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i]++
+		if out[i] != 0 {
+			break
+		}
+	}
+	return out
+}
+
+func decrement(ip []byte) []byte {
+	out := append([]byte(nil), ip...)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i]--
+		if out[i] != 0xff {
+			break
+		}
+	}
+	return out
+}
+
+// Sources describes the database with its type and release date.
+func (d *IP2Location) Sources() []Source {
+	built := time.Date(2000+int(d.meta.Year), time.Month(d.meta.Month), int(d.meta.Day), 0, 0, 0, 0, time.UTC)
+	return []Source{{Kind: KindIP2Location, Path: d.path, DatabaseType: fmt.Sprintf("DB%d", d.meta.DBType),
+		BuildEpoch: uint(built.Unix()), BuildTime: built}}
+}
+
+// Close closes the database file.
+func (d *IP2Location) Close() error {
+	return d.f.Close()
+}
@@ -0,0 +1,102 @@
+package geoip
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// MaxMind reads a MaxMind mmdb database, such as GeoLite2 City.
+type MaxMind struct {
+	path      string
+	db        *maxminddb.Reader
+	languages []string
+}
+
+// maxMindNames are the names of a place by language.
+type maxMindNames map[string]string
+
+// maxMindCity is the part of a City database record the locations are made of.
+type maxMindCity struct {
+	City struct {
+		Names maxMindNames `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string       `maxminddb:"iso_code"`
+		Names   maxMindNames `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string       `maxminddb:"iso_code"`
+		Names   maxMindNames `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+	Location struct {
+		AccuracyRadius uint16  `maxminddb:"accuracy_radius"`
+		Latitude       float64 `maxminddb:"latitude"`
+		Longitude      float64 `maxminddb:"longitude"`
+		TimeZone       string  `maxminddb:"time_zone"`
+	} `maxminddb:"location"`
+}
+
+// OpenMaxMind opens the mmdb database at path. The file is memory mapped. Place names are given in
+// the first of the languages the database has them in, falling back to English. The City databases
+// have names in de, en, es, fr, ja, pt-BR, ru and zh-CN.
+func OpenMaxMind(path string, languages []string) (*MaxMind, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &MaxMind{path: path, db: db, languages: append(append([]string(nil), languages...), "en")}, nil
+}
+
+// name returns the name in the first of the languages it is known in.
+func (m *MaxMind) name(names maxMindNames) string {
+	for _, language := range m.languages {
+		if name, ok := names[language]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// Lookup decodes the record of ip into a location, with the network the record was found for.
+func (m *MaxMind) Lookup(ctx context.Context, ip net.IP) (*Location, error) {
+	var city maxMindCity
+	network, ok, err := m.db.LookupNetwork(ip, &city)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+	loc := &Location{Latitude: city.Location.Latitude, Longitude: city.Location.Longitude,
+		AccuracyRadius: city.Location.AccuracyRadius, Country: city.Country.ISOCode,
+		CountryName: m.name(city.Country.Names), City: m.name(city.City.Names), PostalCode: city.Postal.Code,
+		TimeZone: city.Location.TimeZone, Source: KindMaxMind}
+	// An IPv6 database holding its IPv4 addresses at an unusual depth gives them an IPv6 network,
+	// which does not tell the addresses of the record.
+	if (ip.To4() != nil) == (len(network.IP) == net.IPv4len) {
+		loc.Network = network
+	}
+	// The subdivisions go from the largest to the smallest, the largest is the one named.
+	if len(city.Subdivisions) > 0 {
+		loc.Subdivision, loc.SubdivisionName = city.Subdivisions[0].ISOCode, m.name(city.Subdivisions[0].Names)
+	}
+	return loc, nil
+}
+
+// Sources describes the database with its type and build time.
+func (m *MaxMind) Sources() []Source {
+	meta := m.db.Metadata
+	return []Source{{Kind: KindMaxMind, Path: m.path, DatabaseType: meta.DatabaseType, BuildEpoch: meta.BuildEpoch,
+		BuildTime: time.Unix(int64(meta.BuildEpoch), 0).UTC()}}
+}
+
+// Close unmaps the database.
+func (m *MaxMind) Close() error {
+	return m.db.Close()
+}
@@ -0,0 +1,113 @@
+package geoip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// KindOverride is the source of the locations set in the overrides file.
+const KindOverride = "override"
+
+// overrides maps CIDR ranges to fixed locations, the most specific range containing an address
+// wins. Ranges are kept by prefix length, the keys being their network addresses.
+type overrides struct {
+	source   Source
+	prefixes []int
+	networks map[int]map[string]*Location
+}
+
+// OpenOverrides reads a file of ranges with fixed locations, one per line as
+//
+//	cidr,latitude,longitude,radius_km,country,label
+//
+// for internal networks which do not geolocate or geolocate wrongly. Lines starting with # are
+// skipped. The locations carry the label and KindOverride as their source.
+func OpenOverrides(path string) (Provider, error) {
+	o := &overrides{source: Source{Kind: KindOverride, Path: path}, networks: make(map[int]map[string]*Location)}
+	err := readCSV(path, func(record []string) error {
+		if len(record) != 6 {
+			return errors.New("expected cidr,latitude,longitude,radius_km,country,label")
+		}
+		_, network, err := net.ParseCIDR(record[0])
+		if err != nil {
+			return err
+		}
+		loc, err := parseCoordinates(record[1], record[2])
+		if err != nil {
+			return err
+		}
+		radius, err := strconv.ParseUint(record[3], 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid radius %q", record[3])
+		}
+		loc.AccuracyRadius, loc.Country, loc.Label, loc.Source = uint16(radius), strings.ToUpper(record[4]), record[5], KindOverride
+		ones, bits := network.Mask.Size()
+		prefix := ones + net.IPv6len*8 - bits
+		if o.networks[prefix] == nil {
+			o.networks[prefix] = make(map[string]*Location)
+			o.prefixes = append(o.prefixes, prefix)
+		}
+		key := string(network.IP.To16())
+		if _, ok := o.networks[prefix][key]; ok {
+			return fmt.Errorf("%s is listed twice", network)
+		}
+		o.networks[prefix][key] = loc
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(o.prefixes)))
+	return o, nil
+}
+
+// Lookup returns the location of the most specific range containing ip.
+func (o *overrides) Lookup(ctx context.Context, ip net.IP) (*Location, error) {
+	ip = ip.To16()
+	if ip == nil {
+		return nil, errors.New("geoip: invalid ip address")
+	}
+	for i, prefix := range o.prefixes {
+		network := ip.Mask(net.CIDRMask(prefix, net.IPv6len*8))
+		if loc, ok := o.networks[prefix][string(network)]; ok {
+			found := *loc
+			found.Network = o.network(ip, network, prefix, o.prefixes[:i])
+			return &found, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// network returns the largest network around ip within the range starting at first that holds
+// none of the ranges with the more specific prefixes. Override files are short, every one of those
+// ranges is looked at.
+func (o *overrides) network(ip, first net.IP, prefix int, specific []int) *net.IPNet {
+	start, end := first, lastAddress(first, prefix)
+	for _, p := range specific {
+		for key := range o.networks[p] {
+			rangeStart := net.IP(key)
+			rangeEnd := lastAddress(rangeStart, p)
+			switch {
+			case bytes.Compare(rangeEnd, ip) < 0 && bytes.Compare(rangeEnd, start) >= 0:
+				start = increment(rangeEnd)
+			case bytes.Compare(rangeStart, ip) > 0 && bytes.Compare(rangeStart, end) <= 0:
+				end = decrement(rangeStart)
+			}
+		}
+	}
+	return rangeNetwork(ip, start, end)
+}
+
+func (o *overrides) Sources() []Source {
+	return []Source{o.source}
+}
+
+func (o *overrides) Close() error {
+	return nil
+}
@@ -0,0 +1,187 @@
+package geoip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Kinds of sources a provider can read from.
+const (
+	KindMaxMind     = "maxmind"
+	KindIP2Location = "ip2location"
+	KindCSV         = "csv"
+)
+
+// ErrNotFound is returned by providers that have no location for an ip address.
+var ErrNotFound = errors.New("geoip: no location for the address")
+
+// ErrUnavailable is returned when the GeoIP databases cannot be loaded.
+var ErrUnavailable = errors.New("geoip: databases not usable")
+
+// Location is what a provider knows about where an ip address is. The fields a database does not
+// hold are empty.
+type Location struct {
+	Latitude       float64
+	Longitude      float64
+	AccuracyRadius uint16
+	// Country is the ISO 3166-1 alpha-2 code of the country and Subdivision the ISO 3166-2 code of
+	// the region within it, without the country prefix. The names are in the configured language.
+	Country         string
+	CountryName     string
+	Subdivision     string
+	SubdivisionName string
+	City            string
+	PostalCode      string
+	// TimeZone is the IANA time zone, e.g. Europe/Berlin.
+	TimeZone string
+	// Label names the range of an override.
+	Label string
+	// Source is the kind of source the location came from.
+	Source string
+	// Network is the largest network around the address with the same location, when the provider
+	// knows it. It is nil otherwise.
+	Network *net.IPNet
+}
+
+// Provider looks up the location of ip addresses. Providers are safe for concurrent use.
+type Provider interface {
+	// Lookup returns the location of ip, or ErrNotFound when the provider has none.
+	Lookup(ctx context.Context, ip net.IP) (*Location, error)
+	// Sources describes the databases the provider reads from.
+	Sources() []Source
+	Close() error
+}
+
+// Source describes a database a provider reads from.
+type Source struct {
+	Kind         string    `json:"kind"`
+	Path         string    `json:"path"`
+	DatabaseType string    `json:"databaseType,omitempty"`
+	BuildEpoch   uint      `json:"buildEpoch,omitempty"`
+	BuildTime    time.Time `json:"buildTime,omitzero"`
+}
+
+// SourceSpec names a database file and the kind of provider reading it.
+type SourceSpec struct {
+	Kind string
+	Path string
+}
+
+// ParseSources parses a comma separated list of kind:path sources, e.g.
+// "maxmind:/GeoLite2/GeoLite2-City.mmdb,csv:/etc/superman/ranges.csv".
+func ParseSources(list string) ([]SourceSpec, error) {
+	var specs []SourceSpec
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kind, path, ok := strings.Cut(item, ":")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("geoip: source %q is not kind:path", item)
+		}
+		switch kind {
+		case KindMaxMind, KindIP2Location, KindCSV:
+		default:
+			return nil, fmt.Errorf("geoip: unknown source kind %q", kind)
+		}
+		specs = append(specs, SourceSpec{Kind: kind, Path: path})
+	}
+	if len(specs) == 0 {
+		return nil, errors.New("geoip: no sources")
+	}
+	return specs, nil
+}
+
+// OpenProvider opens the database of a source. IP2Location databases are read from their BIN
+// files, or from their CSV files when the path ends in .csv. Place names are given in the first of
+// the languages a database has them in, see OpenMaxMind.
+func OpenProvider(spec SourceSpec, languages []string) (Provider, error) {
+	switch spec.Kind {
+	case KindMaxMind:
+		return OpenMaxMind(spec.Path, languages)
+	case KindIP2Location:
+		if strings.HasSuffix(strings.ToLower(spec.Path), ".csv") {
+			return OpenIP2LocationCSV(spec.Path)
+		}
+		return OpenIP2Location(spec.Path)
+	case KindCSV:
+		return OpenCSV(spec.Path)
+	case KindOverride:
+		return OpenOverrides(spec.Path)
+	}
+	return nil, fmt.Errorf("geoip: unknown source kind %q", spec.Kind)
+}
+
+// chain asks its providers in order until one of them has a location.
+type chain []Provider
+
+// Chain returns a provider falling back to the next provider whenever one has no location for an
+// address or fails to look it up. A single provider is returned as it is.
+func Chain(providers ...Provider) Provider {
+	if len(providers) == 1 {
+		return providers[0]
+	}
+	return chain(providers)
+}
+
+func (c chain) Lookup(ctx context.Context, ip net.IP) (*Location, error) {
+	var errs []error
+	for i, provider := range c {
+		// The providers after one that failed are only asked while the lookup may still go on.
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		loc, err := provider.Lookup(ctx, ip)
+		if err == nil {
+			if i > 0 {
+				// The network may hold addresses the providers before locate differently.
+				loc.Network = nil
+			}
+			return loc, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return nil, ErrNotFound
+}
+
+func (c chain) Sources() []Source {
+	var sources []Source
+	for _, provider := range c {
+		sources = append(sources, provider.Sources()...)
+	}
+	return sources
+}
+
+func (c chain) Close() error {
+	var errs []error
+	for _, provider := range c {
+		if err := provider.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// openChain opens the providers of the sources, in order.
+func openChain(specs []SourceSpec, languages []string) (Provider, error) {
+	providers := make([]Provider, 0, len(specs))
+	for _, spec := range specs {
+		provider, err := OpenProvider(spec, languages)
+		if err != nil {
+			chain(providers).Close()
+			return nil, err
+		}
+		providers = append(providers, provider)
+	}
+	return Chain(providers...), nil
+}
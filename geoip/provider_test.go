@@ -0,0 +1,259 @@
+package geoip
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// staticProvider answers every lookup the same way.
+type staticProvider struct {
+	loc *Location
+	err error
+}
+
+func (p staticProvider) Lookup(ctx context.Context, ip net.IP) (*Location, error) {
+	return p.loc, p.err
+}
+func (p staticProvider) Sources() []Source { return []Source{{Kind: "static"}} }
+func (p staticProvider) Close() error      { return nil }
+
+func cidr(s string) *net.IPNet {
+	_, network, _ := net.ParseCIDR(s)
+	return network
+}
+
+func TestParseSources(t *testing.T) {
+	specs, err := ParseSources("maxmind:/GeoLite2/GeoLite2-City.mmdb, csv:/etc/ranges.csv")
+	assert.Nil(t, err)
+	assert.Equal(t, []SourceSpec{{KindMaxMind, "/GeoLite2/GeoLite2-City.mmdb"}, {KindCSV, "/etc/ranges.csv"}}, specs)
+
+	_, err = ParseSources("digitalelement:/data/db")
+	assert.NotNil(t, err, "Unknown kinds should be rejected")
+	_, err = ParseSources("/GeoLite2/GeoLite2-City.mmdb")
+	assert.NotNil(t, err, "Sources without a kind should be rejected")
+}
+
+func TestChainFallsBack(t *testing.T) {
+	found := &Location{Latitude: 1, Source: KindCSV, Network: cidr("10.0.0.0/8")}
+	c := Chain(staticProvider{err: ErrNotFound}, staticProvider{err: errors.New("broken")}, staticProvider{loc: found})
+	loc, err := c.Lookup(context.Background(), net.ParseIP("10.0.0.1"))
+	assert.Nil(t, err)
+	assert.Equal(t, &Location{Latitude: 1, Source: KindCSV}, loc,
+		"The first provider with a location should answer, without a network past the first provider")
+	assert.Len(t, c.Sources(), 3)
+	loc, err = Chain(staticProvider{loc: &Location{Network: cidr("10.0.0.0/8")}}, staticProvider{}).Lookup(context.Background(), net.ParseIP("10.0.0.1"))
+	assert.Nil(t, err)
+	assert.Equal(t, cidr("10.0.0.0/8"), loc.Network, "The first provider should keep its network")
+
+	_, err = Chain(staticProvider{err: ErrNotFound}, staticProvider{err: ErrNotFound}).Lookup(context.Background(), net.ParseIP("10.0.0.1"))
+	assert.Equal(t, ErrNotFound, err, "No location from any provider is not found")
+	_, err = Chain(staticProvider{err: errors.New("broken")}, staticProvider{err: ErrNotFound}).Lookup(context.Background(), net.ParseIP("10.0.0.1"))
+	assert.False(t, errors.Is(err, ErrNotFound), "Failures should be reported when no provider answers")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.Lookup(ctx, net.ParseIP("10.0.0.1"))
+	assert.Equal(t, context.Canceled, err, "A cancelled lookup should not ask the providers")
+}
+
+func TestCSV(t *testing.T) {
+	path := writeFile(t, "ranges.csv", []byte(`# start,end,latitude,longitude,radius,country
+10.0.0.0,10.0.255.255,52.52,13.405,5,de
+2001:db8::,2001:db8::ffff,48.8566,2.3522
+`))
+	p, err := OpenProvider(SourceSpec{Kind: KindCSV, Path: path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, err := p.Lookup(context.Background(), net.ParseIP("10.0.12.1"))
+	assert.Nil(t, err)
+	assert.Equal(t, &Location{Latitude: 52.52, Longitude: 13.405, AccuracyRadius: 5, Country: "DE", Source: KindCSV,
+		Network: cidr("10.0.0.0/16")}, loc)
+	loc, err = p.Lookup(context.Background(), net.ParseIP("2001:db8::1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 48.8566, loc.Latitude)
+	assert.Equal(t, cidr("2001:db8::/112"), loc.Network)
+	_, err = p.Lookup(context.Background(), net.ParseIP("10.1.0.0"))
+	assert.Equal(t, ErrNotFound, err)
+
+	overlapping := writeFile(t, "overlap.csv", []byte("10.0.0.0,10.0.0.255,1,1\n10.0.0.128,10.0.1.0,2,2\n"))
+	_, err = OpenCSV(overlapping)
+	assert.NotNil(t, err, "Overlapping ranges should be rejected")
+}
+
+func TestIP2LocationCSV(t *testing.T) {
+	path := writeFile(t, "IP2LOCATION-LITE-DB5.CSV", []byte(`"0","16777215","-","-","-","-","0.000000","0.000000"
+"16777216","16777471","US","United States of America","California","Los Angeles","34.052230","-118.243680"
+`))
+	p, err := OpenProvider(SourceSpec{Kind: KindIP2Location, Path: path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, err := p.Lookup(context.Background(), net.ParseIP("1.0.0.7"))
+	assert.Nil(t, err)
+	assert.Equal(t, &Location{Latitude: 34.05223, Longitude: -118.24368, Country: "US",
+		CountryName: "United States of America", SubdivisionName: "California", City: "Los Angeles",
+		Source: KindIP2Location, Network: cidr("1.0.0.0/24")}, loc)
+	_, err = p.Lookup(context.Background(), net.ParseIP("0.0.0.9"))
+	assert.Equal(t, ErrNotFound, err, "Ranges without a country should have no location")
+}
+
+// binRow is a row of an IP2Location DB5 BIN file.
+type binRow struct {
+	from                               net.IP
+	country, countryName, region, city string
+	lat, lon                           float32
+}
+
+// writeIP2LocationBIN writes a DB5 database with the given IPv4 and IPv6 rows, each table ending
+// with a row starting at the last address.
+func writeIP2LocationBIN(t *testing.T, v4, v6 []binRow) string {
+	const columns, headerSize = 6, 64
+	v4Size, v6Size := columns*4, columns*4+12
+	v4Addr := headerSize
+	v6Addr := v4Addr + (len(v4)+1)*v4Size
+	strings := v6Addr + (len(v6)+1)*v6Size
+	var body, pool bytes.Buffer
+	// pointer stores the strings one after the other and returns the position of the first.
+	pointer := func(values ...string) uint32 {
+		p := uint32(strings + pool.Len())
+		for _, value := range values {
+			pool.WriteByte(byte(len(value)))
+			pool.WriteString(value)
+		}
+		return p
+	}
+	// The country name starts three bytes after the code.
+	countryPointer := func(code, name string) uint32 {
+		p := pointer(code)
+		pool.Write(make([]byte, 2-len(code)))
+		pointer(name)
+		return p
+	}
+	writeRow := func(from []byte, row binRow) {
+		for i := len(from) - 1; i >= 0; i-- {
+			body.WriteByte(from[i])
+		}
+		binary.Write(&body, binary.LittleEndian, []uint32{countryPointer(row.country, row.countryName),
+			pointer(row.region), pointer(row.city),
+			math.Float32bits(row.lat), math.Float32bits(row.lon)})
+	}
+	for _, row := range v4 {
+		writeRow(row.from.To4(), row)
+	}
+	writeRow(net.IPv4bcast.To4(), binRow{country: "-"})
+	for _, row := range v6 {
+		writeRow(row.from.To16(), row)
+	}
+	writeRow(bytes.Repeat([]byte{0xff}, 16), binRow{country: "-"})
+
+	header := make([]byte, headerSize)
+	header[0], header[1], header[2], header[3], header[4] = 5, columns, 26, 10, 1
+	binary.LittleEndian.PutUint32(header[5:], uint32(len(v4)))
+	binary.LittleEndian.PutUint32(header[9:], uint32(v4Addr+1))
+	binary.LittleEndian.PutUint32(header[13:], uint32(len(v6)))
+	binary.LittleEndian.PutUint32(header[17:], uint32(v6Addr+1))
+	return writeFile(t, "IP2LOCATION-LITE-DB5.BIN", append(append(header, body.Bytes()...), pool.Bytes()...))
+}
+
+func TestIP2LocationBIN(t *testing.T) {
+	path := writeIP2LocationBIN(t,
+		[]binRow{{from: net.ParseIP("0.0.0.0"), country: "-"},
+			{net.ParseIP("1.0.0.0"), "US", "United States of America", "California", "Los Angeles", 34.05223, -118.24368},
+			{net.ParseIP("1.0.1.0"), "CN", "China", "Fujian", "Fuzhou", 26.06139, 119.30611},
+			{from: net.ParseIP("1.0.2.0"), country: "-"}},
+		[]binRow{{from: net.ParseIP("::"), country: "-"},
+			{net.ParseIP("2001:db8::"), "DE", "Germany", "Berlin", "Berlin", 52.52437, 13.41053},
+			{from: net.ParseIP("2001:db9::"), country: "-"}})
+	p, err := OpenProvider(SourceSpec{Kind: KindIP2Location, Path: path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	loc, err := p.Lookup(context.Background(), net.ParseIP("1.0.0.255"))
+	assert.Nil(t, err)
+	assert.Equal(t, &Location{Latitude: 34.05223, Longitude: -118.24368, Country: "US",
+		CountryName: "United States of America", SubdivisionName: "California", City: "Los Angeles",
+		Source: KindIP2Location, Network: cidr("1.0.0.0/24")}, loc)
+	loc, err = p.Lookup(context.Background(), net.ParseIP("1.0.1.0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "CN", loc.Country, "A range should start at its first address")
+	loc, err = p.Lookup(context.Background(), net.ParseIP("2001:db8:ffff::1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 52.52437, loc.Latitude, "IPv6 addresses should be searched in the IPv6 rows")
+	assert.Equal(t, cidr("2001:db8::/32"), loc.Network)
+	for _, ip := range []string{"0.0.0.1", "1.0.2.0", "255.255.255.255", "2001:db9::1"} {
+		_, err = p.Lookup(context.Background(), net.ParseIP(ip))
+		assert.Equal(t, ErrNotFound, err, ip)
+	}
+	assert.Equal(t, "DB5", p.Sources()[0].DatabaseType)
+	assert.Equal(t, "2026-10-01T00:00:00Z", p.Sources()[0].BuildTime.Format("2006-01-02T15:04:05Z"))
+}
+
+func TestOverrides(t *testing.T) {
+	path := writeFile(t, "overrides.csv", []byte(`# cidr,latitude,longitude,radius_km,country,label
+10.0.0.0/8,52.52,13.405,50,de,corporate
+10.20.0.0/16,50.1109,8.6821,1,de,"datacenter, fra1"
+2001:db8::/32,48.8566,2.3522,10,fr,paris office
+`))
+	p, err := OpenProvider(SourceSpec{Kind: KindOverride, Path: path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, err := p.Lookup(context.Background(), net.ParseIP("10.20.3.4"))
+	assert.Nil(t, err)
+	assert.Equal(t, &Location{Latitude: 50.1109, Longitude: 8.6821, AccuracyRadius: 1, Country: "DE",
+		Label: "datacenter, fra1", Source: KindOverride, Network: cidr("10.20.0.0/16")}, loc,
+		"The most specific range should win")
+	loc, err = p.Lookup(context.Background(), net.ParseIP("10.21.0.1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "corporate", loc.Label)
+	assert.Equal(t, cidr("10.21.0.0/16"), loc.Network, "The network should leave out the more specific ranges")
+	loc, err = p.Lookup(context.Background(), net.ParseIP("10.0.0.1"))
+	assert.Nil(t, err)
+	assert.Equal(t, cidr("10.0.0.0/12"), loc.Network)
+	loc, err = p.Lookup(context.Background(), net.ParseIP("2001:db8:1::1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "paris office", loc.Label)
+	_, err = p.Lookup(context.Background(), net.ParseIP("11.0.0.1"))
+	assert.Equal(t, ErrNotFound, err)
+
+	duplicate := writeFile(t, "duplicate.csv", []byte("10.0.0.0/8,1,1,1,de,a\n10.0.0.0/8,2,2,1,de,b\n"))
+	_, err = OpenOverrides(duplicate)
+	assert.NotNil(t, err, "A range listed twice should be rejected")
+}
+
+func TestRangeNetwork(t *testing.T) {
+	start, end := net.ParseIP("10.0.0.5"), net.ParseIP("10.0.0.20")
+	assert.Equal(t, cidr("10.0.0.8/29"), rangeNetwork(net.ParseIP("10.0.0.9"), start, end))
+	assert.Equal(t, cidr("10.0.0.5/32"), rangeNetwork(net.ParseIP("10.0.0.5"), start, end))
+	assert.Equal(t, cidr("10.0.0.16/30"), rangeNetwork(net.ParseIP("10.0.0.19"), start, end))
+	assert.Equal(t, cidr("0.0.0.0/0"), rangeNetwork(net.ParseIP("1.2.3.4"), net.ParseIP("0.0.0.0"),
+		net.ParseIP("255.255.255.255")), "IPv4 networks should not reach into IPv6")
+}
+
+func TestMaxMindNames(t *testing.T) {
+	m := &MaxMind{languages: []string{"pt-BR", "de", "en"}}
+	names := maxMindNames{"en": "Munich", "de": "München", "ja": "ミュンヘン"}
+	assert.Equal(t, "München", m.name(names), "The first language with a name should be used")
+	assert.Equal(t, "Munich", m.name(maxMindNames{"en": "Munich"}))
+	assert.Equal(t, "", m.name(nil))
+}
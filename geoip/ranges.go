@@ -0,0 +1,228 @@
+package geoip
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ipRange is a range of addresses, both ends included, in their 16 byte form.
+type ipRange struct {
+	start, end net.IP
+	loc        *Location
+}
+
+// rangeTable looks up addresses in ranges held in memory, sorted by their start.
+type rangeTable struct {
+	source Source
+	ranges []ipRange
+}
+
+// newRangeTable sorts the ranges and checks that they do not overlap.
+func newRangeTable(source Source, ranges []ipRange) (*rangeTable, error) {
+	sort.Slice(ranges, func(i, j int) bool { return bytes.Compare(ranges[i].start, ranges[j].start) < 0 })
+	for i := 1; i < len(ranges); i++ {
+		if bytes.Compare(ranges[i].start, ranges[i-1].end) <= 0 {
+			return nil, fmt.Errorf("geoip: %s: range starting at %s overlaps the one before", source.Path, ranges[i].start)
+		}
+	}
+	return &rangeTable{source: source, ranges: ranges}, nil
+}
+
+func (t *rangeTable) Lookup(ctx context.Context, ip net.IP) (*Location, error) {
+	ip = ip.To16()
+	if ip == nil {
+		return nil, errors.New("geoip: invalid ip address")
+	}
+	i := sort.Search(len(t.ranges), func(i int) bool { return bytes.Compare(t.ranges[i].start, ip) > 0 })
+	if i == 0 || bytes.Compare(ip, t.ranges[i-1].end) > 0 {
+		return nil, ErrNotFound
+	}
+	loc := *t.ranges[i-1].loc
+	loc.Network = rangeNetwork(ip, t.ranges[i-1].start, t.ranges[i-1].end)
+	return &loc, nil
+}
+
+// rangeNetwork returns the largest network containing ip within the range from start to end, both
+// included. IPv4 addresses get IPv4 networks.
+func rangeNetwork(ip, start, end net.IP) *net.IPNet {
+	ip, start, end = ip.To16(), start.To16(), end.To16()
+	// IPv4 addresses are the last 32 bits of their 16 byte form.
+	const v4Prefix = (net.IPv6len - net.IPv4len) * 8
+	ones := 0
+	if ip.To4() != nil {
+		ones = v4Prefix
+	}
+	for ; ones <= net.IPv6len*8; ones++ {
+		mask := net.CIDRMask(ones, net.IPv6len*8)
+		first := ip.Mask(mask)
+		if bytes.Compare(first, start) < 0 || bytes.Compare(lastAddress(first, ones), end) > 0 {
+			continue
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: first.To4(), Mask: net.CIDRMask(ones-v4Prefix, net.IPv4len*8)}
+		}
+		return &net.IPNet{IP: first, Mask: mask}
+	}
+	return nil
+}
+
+// lastAddress returns the last address of the network starting at first, in 16 byte form, whose
+// prefix is ones bits long.
+func lastAddress(first net.IP, ones int) net.IP {
+	mask := net.CIDRMask(ones, net.IPv6len*8)
+	last := make(net.IP, net.IPv6len)
+	for i := range last {
+		last[i] = first[i] | ^mask[i]
+	}
+	return last
+}
+
+func (t *rangeTable) Sources() []Source {
+	return []Source{t.source}
+}
+
+func (t *rangeTable) Close() error {
+	return nil
+}
+
+// readCSV calls parse with each record of the CSV file at path. Lines starting with # are skipped.
+func readCSV(path string, parse func(record []string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = parse(record); err != nil {
+			line, _ := r.FieldPos(0)
+			return fmt.Errorf("geoip: %s:%d: %w", path, line, err)
+		}
+	}
+}
+
+// OpenCSV reads a file of ranges with one range per line as
+//
+//	start_ip,end_ip,latitude,longitude[,radius_km[,country]]
+//
+// Both ends of a range are included and may be IPv4 or IPv6 addresses.
+func OpenCSV(path string) (Provider, error) {
+	var ranges []ipRange
+	err := readCSV(path, func(record []string) error {
+		if len(record) < 4 {
+			return errors.New("expected start_ip,end_ip,latitude,longitude")
+		}
+		start, end := net.ParseIP(record[0]), net.ParseIP(record[1])
+		if start == nil || end == nil || bytes.Compare(start.To16(), end.To16()) > 0 {
+			return fmt.Errorf("invalid range %s-%s", record[0], record[1])
+		}
+		loc, err := parseCoordinates(record[2], record[3])
+		if err != nil {
+			return err
+		}
+		loc.Source = KindCSV
+		if len(record) > 4 && record[4] != "" {
+			radius, err := strconv.ParseUint(record[4], 10, 16)
+			if err != nil {
+				return fmt.Errorf("invalid radius %q", record[4])
+			}
+			loc.AccuracyRadius = uint16(radius)
+		}
+		if len(record) > 5 {
+			loc.Country = strings.ToUpper(record[5])
+		}
+		ranges = append(ranges, ipRange{start: start.To16(), end: end.To16(), loc: loc})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newRangeTable(Source{Kind: KindCSV, Path: path}, ranges)
+}
+
+// OpenIP2LocationCSV reads an IP2Location CSV database of type DB5 or above, IPv4 or IPv6. Its
+// lines start with
+//
+//	"ip_from","ip_to","country_code","country_name","region_name","city_name","latitude","longitude"
+//
+// where the addresses are decimal numbers. Ranges without a country have no location. Place names
+// are in English.
+func OpenIP2LocationCSV(path string) (Provider, error) {
+	var ranges []ipRange
+	err := readCSV(path, func(record []string) error {
+		if len(record) < 8 {
+			return errors.New("expected a DB5 or above database with latitude and longitude")
+		}
+		if record[2] == "-" {
+			return nil
+		}
+		start, err := decimalIP(record[0])
+		if err != nil {
+			return err
+		}
+		end, err := decimalIP(record[1])
+		if err != nil {
+			return err
+		}
+		loc, err := parseCoordinates(record[6], record[7])
+		if err != nil {
+			return err
+		}
+		loc.Country, loc.CountryName, loc.SubdivisionName, loc.City = record[2], record[3], record[4], record[5]
+		loc.Source = KindIP2Location
+		ranges = append(ranges, ipRange{start: start, end: end, loc: loc})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newRangeTable(Source{Kind: KindIP2Location, Path: path, DatabaseType: "CSV"}, ranges)
+}
+
+func parseCoordinates(latitude, longitude string) (*Location, error) {
+	lat, err := strconv.ParseFloat(latitude, 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return nil, fmt.Errorf("invalid latitude %q", latitude)
+	}
+	lon, err := strconv.ParseFloat(longitude, 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return nil, fmt.Errorf("invalid longitude %q", longitude)
+	}
+	return &Location{Latitude: lat, Longitude: lon}, nil
+}
+
+var maxIPv4 = big.NewInt(1<<32 - 1)
+
+// decimalIP converts an address written as a decimal number to its 16 byte form. Numbers up to
+// 2^32-1 are IPv4 addresses.
+func decimalIP(s string) (net.IP, error) {
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok || n.Sign() < 0 || n.BitLen() > 128 {
+		return nil, fmt.Errorf("invalid address number %q", s)
+	}
+	if n.Cmp(maxIPv4) <= 0 {
+		v := n.Uint64()
+		return net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v)).To16(), nil
+	}
+	return net.IP(n.FillBytes(make([]byte, net.IPv6len))), nil
+}
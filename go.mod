@@ -1,15 +1,18 @@
 module github.com/anyaddres/supermann
 
+go 1.24
+
 require (
 	github.com/corpix/uarand v0.0.0-20170903190822-2b8494104d86 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/icrowley/fake v0.0.0-20180203215853-4178557ae428
 	github.com/joeshaw/envdecode v0.0.0-20180312135643-c9e015854467
 	github.com/mattn/go-sqlite3 v1.10.0
-	github.com/oschwald/maxminddb-golang v1.3.0
+	github.com/oschwald/maxminddb-golang v1.6.0
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.1.1 // indirect
-	github.com/stretchr/testify v1.2.2
+	github.com/stretchr/testify v1.4.0
 	github.com/umahmood/haversine v0.0.0-20151105152445-808ab04add26
-	golang.org/x/sys v0.0.0-20181107165924-66b7b1311ac8 // indirect
+	golang.org/x/sys v0.0.0-20191224085550-c709ea063b76 // indirect
+	gopkg.in/yaml.v2 v2.2.2 // indirect
 )
@@ -0,0 +1,124 @@
+// Package logging sets up structured JSON logging through log/slog. Records carry the id of the
+// request they were logged for, the level can be changed while running and usernames and ip
+// addresses can be redacted.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/anyaddres/supermann/tracing"
+)
+
+const (
+	// KeyRequestID is the attribute holding the id of the request a record was logged for.
+	KeyRequestID = "request_id"
+	// KeyTraceID and KeySpanID hold the trace and span a record was logged in, when tracing.
+	KeyTraceID = "trace_id"
+	KeySpanID  = "span_id"
+	// KeyUser is the attribute for usernames, which are redacted when redaction is on.
+	KeyUser = "user"
+	// KeyIP is the attribute for ip addresses, which are redacted when redaction is on.
+	KeyIP = "ip"
+	// KeyError is the attribute for errors.
+	KeyError = "error"
+
+	// Redacted replaces redacted values.
+	Redacted = "[redacted]"
+)
+
+// level is the minimum level logged, shared by every logger set up here.
+var level = new(slog.LevelVar)
+
+type requestIDKey struct{}
+
+// Setup makes a JSON logger writing to w the default logger of both log/slog and log. Records
+// below lvl are dropped. When redact is set the values of the user and ip attributes are
+// replaced.
+func Setup(w io.Writer, lvl string, redact bool) error {
+	if err := SetLevel(lvl); err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	if redact {
+		opts.ReplaceAttr = redactAttr
+	}
+	// This also sends the records of the log package through the logger, at info level.
+	slog.SetDefault(slog.New(&contextHandler{Handler: slog.NewJSONHandler(w, opts)}))
+	return nil
+}
+
+// Level returns the name of the current level.
+func Level() string {
+	return strings.ToLower(level.Level().String())
+}
+
+// SetLevel changes the level of every logger set up here to debug, info, warn or error.
+func SetLevel(lvl string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(lvl)); err != nil {
+		return fmt.Errorf("invalid log level %q, expected debug, info, warn or error", lvl)
+	}
+	level.Set(l)
+	return nil
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == KeyUser || a.Key == KeyIP {
+		a.Value = slog.StringValue(Redacted)
+	}
+	return a
+}
+
+// Took returns the milliseconds since start as the took_ms attribute.
+func Took(start time.Time) slog.Attr {
+	return slog.Float64("took_ms", float64(time.Since(start))/float64(time.Millisecond))
+}
+
+// NewRequestID returns a random request id.
+func NewRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// WithRequestID returns a context carrying the request id, which every record logged with it
+// includes.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request id carried by the context, or an empty string.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// contextHandler adds the request id and the span of the context to each record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String(KeyRequestID, id))
+	}
+	if span := tracing.FromContext(ctx); span != nil {
+		r.AddAttrs(slog.String(KeyTraceID, span.TraceID), slog.String(KeySpanID, span.SpanID))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,49 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func lastRecord(t *testing.T, buf *bytes.Buffer) map[string]interface{} {
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	record := make(map[string]interface{})
+	if err := json.Unmarshal(lines[len(lines)-1], &record); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestRequestIDAndRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, Setup(&buf, "info", true))
+	ctx := WithRequestID(context.Background(), "4bf92f3577b34da6")
+	slog.InfoContext(ctx, "suspicious login", KeyUser, "bob", KeyIP, "18.118.60.44", "event_uuid", "85ad929a")
+
+	record := lastRecord(t, &buf)
+	assert.Equal(t, "INFO", record["level"])
+	assert.Equal(t, "4bf92f3577b34da6", record[KeyRequestID], "The request id of the context should be logged")
+	assert.Equal(t, Redacted, record[KeyUser], "Usernames should be redacted")
+	assert.Equal(t, Redacted, record[KeyIP], "Ip addresses should be redacted")
+	assert.Equal(t, "85ad929a", record["event_uuid"], "Other attributes should be kept")
+}
+
+func TestSetLevel(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, Setup(&buf, "warn", false))
+	slog.Info("dropped")
+	assert.Equal(t, 0, buf.Len(), "Records below the level should be dropped")
+
+	assert.Nil(t, SetLevel("debug"))
+	assert.Equal(t, "debug", Level())
+	slog.Debug("kept", KeyUser, "bob")
+	assert.Equal(t, "bob", lastRecord(t, &buf)[KeyUser], "Usernames should be kept without redaction")
+
+	assert.NotNil(t, SetLevel("verbose"), "Unknown levels should be rejected")
+	assert.Equal(t, "debug", Level(), "A rejected level should not change the level")
+}
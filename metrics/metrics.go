@@ -0,0 +1,354 @@
+// Package metrics keeps counters, gauges and histograms and exposes them in the Prometheus text
+// format. Metrics are registered on the default registry when they are created and usually live
+// in package level variables.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets are the default histogram buckets, in seconds, suited to request latencies.
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// DefaultRegistry holds every metric created by this package.
+var DefaultRegistry = &Registry{}
+
+// Registry is a set of metrics exposed together.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+func (r *Registry) register(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, existing := range r.metrics {
+		if existing.name() == m.name() {
+			panic("metrics: duplicate metric " + m.name())
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// ServeHTTP writes every metric of the registry in the Prometheus text format.
+func (r *Registry) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.mutex.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mutex.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name() < metrics[j].name() })
+	w := bufio.NewWriter(writer)
+	for _, m := range metrics {
+		m.write(w)
+	}
+	w.Flush()
+}
+
+// Handler returns the handler serving the default registry.
+func Handler() http.Handler {
+	return DefaultRegistry
+}
+
+// labelEscaper escapes label values as the text format expects.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// desc describes a metric family.
+type desc struct {
+	fqName string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) name() string {
+	return d.fqName
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.fqName, strings.Replace(d.help, "\n", " ", -1), d.fqName, d.kind)
+}
+
+// labelPairs formats the label values, along with any extra name and value pairs, as a label set.
+func (d *desc) labelPairs(values []string, extra ...string) string {
+	if len(values) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(values)+len(extra)/2)
+	for i, v := range values {
+		pairs = append(pairs, d.labels[i]+`="`+labelEscaper.Replace(v)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// value is a float64 updated atomically.
+type value struct {
+	bits uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, updated) {
+			return
+		}
+	}
+}
+
+func (v *value) set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// series holds the children of a metric family by their label values.
+type series struct {
+	mutex    sync.RWMutex
+	children map[string]interface{}
+	values   map[string][]string
+}
+
+func newSeries() series {
+	return series{children: make(map[string]interface{}), values: make(map[string][]string)}
+}
+
+func (s *series) get(labels []string, values []string, create func() interface{}) interface{} {
+	if len(values) != len(labels) {
+		panic(fmt.Sprintf("metrics: expected %d label values, got %d", len(labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s.mutex.RLock()
+	child, ok := s.children[key]
+	s.mutex.RUnlock()
+	if ok {
+		return child
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if child, ok = s.children[key]; !ok {
+		child = create()
+		s.children[key] = child
+		s.values[key] = append([]string(nil), values...)
+	}
+	return child
+}
+
+// each calls fn for every child in the order of their label values.
+func (s *series) each(fn func(values []string, child interface{})) {
+	s.mutex.RLock()
+	keys := make([]string, 0, len(s.children))
+	for key := range s.children {
+		keys = append(keys, key)
+	}
+	s.mutex.RUnlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		s.mutex.RLock()
+		child, values := s.children[key], s.values[key]
+		s.mutex.RUnlock()
+		fn(values, child)
+	}
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	v value
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add adds delta, which must not be negative, to the counter.
+func (c *Counter) Add(delta float64) {
+	c.v.add(delta)
+}
+
+// Value returns the current count.
+func (c *Counter) Value() float64 {
+	return c.v.get()
+}
+
+// CounterVec is a family of counters partitioned by label values.
+type CounterVec struct {
+	desc
+	series
+}
+
+// NewCounterVec creates and registers a counter family.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{desc: desc{fqName: name, help: help, kind: "counter", labels: labels}, series: newSeries()}
+	DefaultRegistry.register(c)
+	return c
+}
+
+// With returns the counter for the label values, in the order the labels were declared.
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.get(c.labels, values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.each(func(values []string, child interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", c.fqName, c.labelPairs(values), formatFloat(child.(*Counter).v.get()))
+	})
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	v value
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64) {
+	g.v.set(v)
+}
+
+// Add adds delta to the gauge.
+func (g *Gauge) Add(delta float64) {
+	g.v.add(delta)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() float64 {
+	return g.v.get()
+}
+
+// GaugeVec is a family of gauges partitioned by label values.
+type GaugeVec struct {
+	desc
+	series
+}
+
+// NewGaugeVec creates and registers a gauge family.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{desc: desc{fqName: name, help: help, kind: "gauge", labels: labels}, series: newSeries()}
+	DefaultRegistry.register(g)
+	return g
+}
+
+// With returns the gauge for the label values, in the order the labels were declared.
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return g.get(g.labels, values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	g.each(func(values []string, child interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", g.fqName, g.labelPairs(values), formatFloat(child.(*Gauge).v.get()))
+	})
+}
+
+// Sample is one value of a GaugeFunc.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// GaugeFunc is a gauge family whose values are collected when the metrics are scraped.
+type GaugeFunc struct {
+	desc
+	collect func() []Sample
+}
+
+// NewGaugeFunc creates and registers a gauge family whose samples are returned by collect.
+func NewGaugeFunc(name, help string, collect func() []Sample, labels ...string) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{fqName: name, help: help, kind: "gauge", labels: labels}, collect: collect}
+	DefaultRegistry.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	for _, s := range g.collect() {
+		fmt.Fprintf(w, "%s%s %s\n", g.fqName, g.labelPairs(s.LabelValues), formatFloat(s.Value))
+	}
+}
+
+// Histogram counts observations into buckets.
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     value
+}
+
+// Observe adds an observation.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+	h.sum.add(v)
+}
+
+// HistogramVec is a family of histograms partitioned by label values.
+type HistogramVec struct {
+	desc
+	series
+	buckets []float64
+}
+
+// NewHistogramVec creates and registers a histogram family with the given upper bucket bounds,
+// which have to be sorted.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{desc: desc{fqName: name, help: help, kind: "histogram", labels: labels}, series: newSeries(),
+		buckets: buckets}
+	DefaultRegistry.register(h)
+	return h
+}
+
+// With returns the histogram for the label values, in the order the labels were declared.
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.get(h.labels, values, func() interface{} {
+		return &Histogram{buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+	}).(*Histogram)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.each(func(values []string, child interface{}) {
+		hist := child.(*Histogram)
+		var cumulative uint64
+		for i, bound := range hist.buckets {
+			cumulative += atomic.LoadUint64(&hist.counts[i])
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.fqName, h.labelPairs(values, "le", formatFloat(bound)), cumulative)
+		}
+		count := atomic.LoadUint64(&hist.count)
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.fqName, h.labelPairs(values, "le", "+Inf"), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.fqName, h.labelPairs(values), formatFloat(hist.sum.get()))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.fqName, h.labelPairs(values), count)
+	})
+}
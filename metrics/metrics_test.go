@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T) string {
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4", rec.Header().Get("Content-Type"))
+	return rec.Body.String()
+}
+
+func TestExposition(t *testing.T) {
+	requests := NewCounterVec("test_requests_total", "Requests served.", "route", "status")
+	requests.With("/api/events/", "200").Inc()
+	requests.With("/api/events/", "200").Add(2)
+	requests.With("/api/events/", "404").Inc()
+	NewGaugeVec("test_temperature", "A gauge.").With().Set(-1.5)
+	latency := NewHistogramVec("test_latency_seconds", "A histogram.", []float64{0.1, 1}, "op")
+	latency.With("insert").Observe(0.05)
+	latency.With("insert").Observe(0.5)
+	latency.With("insert").Observe(3)
+	NewGaugeFunc("test_size_bytes", "A gauge func.", func() []Sample {
+		return []Sample{{LabelValues: []string{`a"b`}, Value: 42}}
+	}, "file")
+
+	out := scrape(t)
+	assert.Contains(t, out, "# HELP test_requests_total Requests served.\n# TYPE test_requests_total counter\n"+
+		`test_requests_total{route="/api/events/",status="200"} 3`+"\n"+
+		`test_requests_total{route="/api/events/",status="404"} 1`+"\n")
+	assert.Contains(t, out, "test_temperature -1.5\n")
+	assert.Contains(t, out, "# TYPE test_latency_seconds histogram\n"+
+		`test_latency_seconds_bucket{op="insert",le="0.1"} 1`+"\n"+
+		`test_latency_seconds_bucket{op="insert",le="1"} 2`+"\n"+
+		`test_latency_seconds_bucket{op="insert",le="+Inf"} 3`+"\n"+
+		`test_latency_seconds_sum{op="insert"} 3.55`+"\n"+
+		`test_latency_seconds_count{op="insert"} 3`+"\n")
+	assert.Contains(t, out, `test_size_bytes{file="a\"b"} 42`+"\n")
+	assert.True(t, strings.Index(out, "test_latency_seconds") < strings.Index(out, "test_requests_total"),
+		"Metrics should be sorted by name")
+}
+
+func TestDuplicateMetricPanics(t *testing.T) {
+	NewCounterVec("test_duplicate_total", "A counter.")
+	assert.Panics(t, func() { NewCounterVec("test_duplicate_total", "A counter.") })
+}
@@ -0,0 +1,232 @@
+// Package tracing records spans and propagates them in W3C traceparent headers. Finished spans are
+// written as JSON lines, one span per line with the field names of the OpenTelemetry protocol, so
+// they can be loaded into a collector or read without one.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// TraceparentHeader carries the trace context of a request, see https://www.w3.org/TR/trace-context/.
+	TraceparentHeader = "traceparent"
+
+	// KindServer is the kind of spans handling a request, KindInternal that of all the others.
+	KindServer   = "SPAN_KIND_SERVER"
+	KindInternal = "SPAN_KIND_INTERNAL"
+
+	statusError = "STATUS_CODE_ERROR"
+
+	// ServiceName is recorded as the service.name resource of every span.
+	ServiceName = "superman"
+)
+
+var traceparentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// exporter writes finished spans, it is nil when tracing is disabled.
+var exporter struct {
+	sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	ratio  float64
+}
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+	Sampled bool
+}
+
+// Traceparent formats the span context as a traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID + "-" + sc.SpanID + "-" + flags
+}
+
+// Span is an operation being traced. The methods of a nil span do nothing.
+type Span struct {
+	SpanContext
+	parentID  string
+	name      string
+	kind      string
+	start     time.Time
+	mutex     sync.Mutex
+	attrs     map[string]interface{}
+	errorText string
+	failed    bool
+}
+
+type spanKey struct{}
+
+// Setup starts writing spans to w, which is closed by Close if it is an io.Closer. Traces started
+// here, without a sampled parent, are recorded with the given probability.
+func Setup(w io.Writer, ratio float64) {
+	exporter.Lock()
+	defer exporter.Unlock()
+	exporter.w, exporter.ratio = w, ratio
+	exporter.closer, _ = w.(io.Closer)
+}
+
+// Close stops recording spans and closes the writer they went to.
+func Close() error {
+	exporter.Lock()
+	defer exporter.Unlock()
+	var err error
+	if exporter.closer != nil {
+		err = exporter.closer.Close()
+	}
+	exporter.w, exporter.closer = nil, nil
+	return err
+}
+
+func enabled() (bool, float64) {
+	exporter.Lock()
+	defer exporter.Unlock()
+	return exporter.w != nil, exporter.ratio
+}
+
+func randomHex(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// sample decides whether a new trace is recorded.
+func sample(ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1<<53))
+	return err == nil && float64(n.Int64())/(1<<53) < ratio
+}
+
+// Extract returns a context carrying the span context of a valid traceparent header, which the
+// spans started with it continue.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	m := traceparentPattern.FindStringSubmatch(header.Get(TraceparentHeader))
+	if m == nil || m[1] == "00000000000000000000000000000000" || m[2] == "0000000000000000" {
+		return ctx
+	}
+	flags, _ := strconv.ParseUint(m[3], 16, 8)
+	remote := &Span{SpanContext: SpanContext{TraceID: m[1], SpanID: m[2], Sampled: flags&1 == 1}}
+	return context.WithValue(ctx, spanKey{}, remote)
+}
+
+// Inject sets the traceparent header to the span of the context, if there is one.
+func Inject(ctx context.Context, header http.Header) {
+	if span := FromContext(ctx); span != nil {
+		header.Set(TraceparentHeader, span.Traceparent())
+	}
+}
+
+// FromContext returns the current span of the context, or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Start starts an internal span as a child of the span of the context and returns a context
+// carrying it. It returns the context unchanged and a nil span when tracing is disabled.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return StartAt(ctx, name, KindInternal, time.Now())
+}
+
+// StartAt starts a span of the given kind at the given time.
+func StartAt(ctx context.Context, name, kind string, start time.Time) (context.Context, *Span) {
+	on, ratio := enabled()
+	if !on {
+		return ctx, nil
+	}
+	span := &Span{name: name, kind: kind, start: start, SpanContext: SpanContext{SpanID: randomHex(8)}}
+	if parent := FromContext(ctx); parent != nil {
+		span.TraceID, span.parentID, span.Sampled = parent.TraceID, parent.SpanID, parent.Sampled
+	} else {
+		span.TraceID, span.Sampled = randomHex(16), sample(ratio)
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SetAttribute records an attribute of the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+}
+
+// SetError marks the span as failed with the error, it does nothing when err is nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failed, s.errorText = true, err.Error()
+}
+
+// spanJSON is a span as exported.
+type spanJSON struct {
+	TraceID           string                 `json:"traceId"`
+	SpanID            string                 `json:"spanId"`
+	ParentSpanID      string                 `json:"parentSpanId,omitempty"`
+	Name              string                 `json:"name"`
+	Kind              string                 `json:"kind"`
+	StartTimeUnixNano string                 `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string                 `json:"endTimeUnixNano"`
+	Attributes        map[string]interface{} `json:"attributes,omitempty"`
+	Status            *spanStatus            `json:"status,omitempty"`
+	Resource          map[string]string      `json:"resource"`
+}
+
+type spanStatus struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// End finishes the span and exports it if its trace is sampled.
+func (s *Span) End() {
+	if s == nil || !s.Sampled {
+		return
+	}
+	end := time.Now()
+	s.mutex.Lock()
+	out := spanJSON{TraceID: s.TraceID, SpanID: s.SpanID, ParentSpanID: s.parentID, Name: s.name, Kind: s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10), EndTimeUnixNano: strconv.FormatInt(end.UnixNano(), 10),
+		Attributes: s.attrs, Resource: map[string]string{"service.name": ServiceName}}
+	if s.failed {
+		out.Status = &spanStatus{Code: statusError, Message: s.errorText}
+	}
+	s.mutex.Unlock()
+	line, err := json.Marshal(out)
+	if err != nil {
+		line = []byte(fmt.Sprintf(`{"traceId":%q,"spanId":%q,"name":%q}`, s.TraceID, s.SpanID, s.name))
+	}
+	exporter.Lock()
+	defer exporter.Unlock()
+	if exporter.w != nil {
+		exporter.w.Write(append(line, '\n'))
+	}
+}
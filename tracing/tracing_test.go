@@ -0,0 +1,84 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func exported(t *testing.T, buf *bytes.Buffer) []spanJSON {
+	var spans []spanJSON
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var span spanJSON
+		if err := json.Unmarshal(line, &span); err != nil {
+			t.Fatal(err)
+		}
+		spans = append(spans, span)
+	}
+	return spans
+}
+
+func TestSpansContinueTraceparent(t *testing.T) {
+	var buf bytes.Buffer
+	Setup(&buf, 1)
+	defer Close()
+	header := http.Header{}
+	header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := Extract(context.Background(), header)
+
+	ctx, server := StartAt(ctx, "POST /api/identifylogins/", KindServer, time.Now())
+	_, child := Start(ctx, "geoip.lookup")
+	child.SetAttribute("cache.hit", false)
+	child.SetError(errors.New("lookup failed"))
+	child.End()
+	server.End()
+
+	spans := exported(t, &buf)
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[1].TraceID, "The caller's trace should be continued")
+	assert.Equal(t, "00f067aa0ba902b7", spans[1].ParentSpanID, "The server span should be a child of the caller's")
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID, "The lookup should be a child of the server span")
+	assert.Equal(t, KindServer, spans[1].Kind)
+	assert.Equal(t, false, spans[0].Attributes["cache.hit"])
+	assert.Equal(t, &spanStatus{Code: statusError, Message: "lookup failed"}, spans[0].Status)
+
+	out := http.Header{}
+	Inject(ctx, out)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+server.SpanID+"-01", out.Get(TraceparentHeader))
+}
+
+func TestUnsampledAndInvalidTraceparent(t *testing.T) {
+	var buf bytes.Buffer
+	Setup(&buf, 1)
+	defer Close()
+	header := http.Header{}
+	header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, span := Start(Extract(context.Background(), header), "unsampled")
+	span.End()
+	assert.Equal(t, 0, buf.Len(), "Spans of traces the caller did not sample should not be exported")
+
+	header.Set(TraceparentHeader, "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	_, span = Start(Extract(context.Background(), header), "root")
+	span.End()
+	spans := exported(t, &buf)
+	assert.Len(t, spans, 1)
+	assert.Empty(t, spans[0].ParentSpanID, "An invalid traceparent should start a new trace")
+	assert.NotEqual(t, "00000000000000000000000000000000", spans[0].TraceID)
+}
+
+func TestDisabled(t *testing.T) {
+	ctx, span := Start(context.Background(), "disabled")
+	assert.Nil(t, span, "No span should be started when tracing is disabled")
+	span.SetAttribute("ignored", true)
+	span.End()
+	assert.Nil(t, FromContext(ctx))
+}